@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"time"
+)
+
+// first line of signed packets: #sig:KEYID:TIMESTAMP:HMAC
+var packetSignaturePrefix = []byte("#sig:")
+
+// maximum age of signed packets if Configuration.MaxTimestampSkew is 0
+const packetAuthDefaultWindow = 300 * time.Second
+
+// Checks the signature of a datagram received on listener, in the format:
+//
+//	#sig:KEYID:TIMESTAMP:HMAC
+//	PAYLOAD
+//
+// where TIMESTAMP is the unix time in seconds when the packet was signed, and HMAC is the
+// hex-encoded HMAC-SHA256 of TIMESTAMP, a newline and PAYLOAD using the secret of the key.
+// Packets signed more than Configuration.MaxTimestampSkew seconds from now are dropped,
+// so captured packets cannot be replayed later.
+// Returns the payload and the app of the key, which is blank if unsigned packets
+// are accepted. Dropped packets are counted in the _system.auth#LISTENER.unsigned,
+// _system.auth#LISTENER.badsig and _system.auth#LISTENER.expired internal counters.
+func PacketAuth(listener string, addr net.Addr, msg []byte) ([]byte, string, bool) {
+	configMu.RLock()
+	required := Configuration.AuthRequired
+	keys := Configuration.AuthKeys
+	window := time.Duration(Configuration.MaxTimestampSkew) * time.Second
+	configMu.RUnlock()
+
+	if window <= 0 {
+		window = packetAuthDefaultWindow
+	}
+
+	if !bytes.HasPrefix(msg, packetSignaturePrefix) {
+		if required {
+			log.Warning("Dropping unsigned packet from %s on %s", addr, listener)
+			SystemCount("_system.auth#"+listener+".unsigned", 1)
+			return nil, "", false
+		}
+		return msg, "", true
+	}
+
+	key, payload, signed, ok := packetAuthVerify(keys, msg[len(packetSignaturePrefix):])
+	if !ok {
+		log.Warning("Dropping packet with invalid signature from %s on %s", addr, listener)
+		SystemCount("_system.auth#"+listener+".badsig", 1)
+		return nil, "", false
+	}
+
+	age := time.Since(signed)
+	if age < 0 {
+		age = -age
+	}
+	if age > window {
+		log.Warning("Dropping packet signed at %s from %s on %s", signed.Format(time.RFC3339), addr, listener)
+		SystemCount("_system.auth#"+listener+".expired", 1)
+		return nil, "", false
+	}
+	return payload, key.App, true
+}
+
+// Returns the key, payload and signing time of a valid signed message
+func packetAuthVerify(keys []AuthKey, msg []byte) (*AuthKey, []byte, time.Time, bool) {
+	nl := bytes.IndexByte(msg, '\n')
+	if nl < 0 {
+		return nil, nil, time.Time{}, false
+	}
+	header, payload := msg[:nl], msg[nl+1:]
+
+	fields := bytes.Split(bytes.TrimRight(header, "\r"), []byte(":"))
+	if len(fields) != 3 {
+		return nil, nil, time.Time{}, false
+	}
+	keyid := string(fields[0])
+	ts, err := strconv.ParseInt(string(fields[1]), 10, 64)
+	if err != nil {
+		return nil, nil, time.Time{}, false
+	}
+	signature, err := hex.DecodeString(string(fields[2]))
+	if err != nil {
+		return nil, nil, time.Time{}, false
+	}
+
+	for i := range keys {
+		key := &keys[i]
+		if key.Id == keyid {
+			mac := hmac.New(sha256.New, []byte(key.Secret))
+			mac.Write(fields[1])
+			mac.Write([]byte("\n"))
+			mac.Write(payload)
+			if !hmac.Equal(mac.Sum(nil), signature) {
+				return nil, nil, time.Time{}, false
+			}
+			return key, payload, time.Unix(ts, 0), true
+		}
+	}
+	return nil, nil, time.Time{}, false
+}
+
+// Checks if the app is allowed by the key used to sign the packet.
+// Records of other apps are counted in the _system.auth#LISTENER.wrongapp internal counter.
+func packetAuthAllowApp(listener string, addr net.Addr, authapp string, app string) bool {
+	if authapp == "" || authapp == app {
+		return true
+	}
+	log.Warning("Dropping record of app %s signed with a key of app %s from %s on %s", app, authapp, addr, listener)
+	SystemCount("_system.auth#"+listener+".wrongapp", 1)
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func packetAuthSign(secret string, tm time.Time, payload string) string {
+	ts := strconv.FormatInt(tm.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\n" + payload))
+	return ts + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPacketAuth(t *testing.T) {
+	defer func(required bool, keys []AuthKey) {
+		Configuration.AuthRequired = required
+		Configuration.AuthKeys = keys
+	}(Configuration.AuthRequired, Configuration.AuthKeys)
+
+	Configuration.AuthKeys = []AuthKey{{Id: "k1", Secret: "secret", App: "app1"}}
+
+	payload := "app1.conn.ct:1|c"
+	signature := packetAuthSign("secret", time.Now(), payload)
+
+	tests := []struct {
+		msg      string
+		required bool
+		ok       bool
+		app      string
+	}{
+		{"#sig:k1:" + signature + "\n" + payload, true, true, "app1"},
+		{"#sig:k1:" + signature + "\n" + payload + "x", false, false, ""},
+		{"#sig:k2:" + signature + "\n" + payload, false, false, ""},
+		{"#sig:k1:" + strconv.FormatInt(time.Now().Unix()+1, 10) + signature[strings.Index(signature, ":"):] + "\n" + payload, false, false, ""},
+		{"#sig:k1:zz\n" + payload, false, false, ""},
+		{payload, false, true, ""},
+		{payload, true, false, ""},
+	}
+
+	for _, tt := range tests {
+		Configuration.AuthRequired = tt.required
+		msg, app, ok := PacketAuth("statsd", nil, []byte(tt.msg))
+		if ok != tt.ok || app != tt.app {
+			t.Errorf("message %q: expected ok=%t app=%q, got ok=%t app=%q", tt.msg, tt.ok, tt.app, ok, app)
+			continue
+		}
+		if ok && string(msg) != payload {
+			t.Errorf("message %q: expected payload %q, got %q", tt.msg, payload, msg)
+		}
+	}
+
+	if packetAuthAllowApp("statsd", nil, "app1", "app2") {
+		t.Error("records of other apps should not be allowed")
+	}
+}
+
+func TestPacketAuthReplay(t *testing.T) {
+	defer func(required bool, keys []AuthKey, maxskew int32) {
+		Configuration.AuthRequired = required
+		Configuration.AuthKeys = keys
+		Configuration.MaxTimestampSkew = maxskew
+	}(Configuration.AuthRequired, Configuration.AuthKeys, Configuration.MaxTimestampSkew)
+
+	Configuration.AuthRequired = true
+	Configuration.AuthKeys = []AuthKey{{Id: "k1", Secret: "secret", App: "app1"}}
+
+	payload := "app1.conn.ct:1|c"
+	tests := []struct {
+		maxskew int32
+		age     time.Duration
+		ok      bool
+	}{
+		{60, 30 * time.Second, true},
+		{60, 90 * time.Second, false},
+		{60, -90 * time.Second, false},
+		{0, 200 * time.Second, true},
+		{0, 400 * time.Second, false},
+	}
+	for _, tt := range tests {
+		Configuration.MaxTimestampSkew = tt.maxskew
+		msg := "#sig:k1:" + packetAuthSign("secret", time.Now().Add(-tt.age), payload) + "\n" + payload
+		if _, _, ok := PacketAuth("statsd", nil, []byte(msg)); ok != tt.ok {
+			t.Errorf("packet signed %s ago with skew %d: expected ok=%t", tt.age, tt.maxskew, tt.ok)
+		}
+	}
+}
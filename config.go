@@ -1,44 +1,403 @@
 package main
 
 import (
+	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/RangelReale/appstatsd/data"
+	"github.com/RangelReale/appstatsd/infohttp"
+	"github.com/op/go-logging"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
 )
 
 var Configuration *Config
 
+var (
+	prometheusNameRE  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	prometheusLabelRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// guards the settings that can be changed by a reload, see ReloadConfig
+var configMu sync.RWMutex
+
 func init() {
 	Configuration = NewConfig()
 }
 
 type Config struct {
+	// level of the process log: critical, error, warning, notice, info or debug
+	LoggingLevel string
+
 	StatsdPort      int32
 	LogPort         int32
+	SyslogPort      int32 // 0 to disable
+	InfoPort        int32
 	ListenHost      string
+	InfoListenHost  string // host of the info server, empty for all interfaces
 	ErrorStatistics bool
 
+	// which log levels increment which error statistics buckets
+	ErrorStatisticsRules []ErrorStatisticsRule
+
+	// statsd tcp listener, port 0 to disable. idle timeout in seconds, 0 for no limits
+	StatsdTCPPort           int32
+	StatsdTCPMaxConnections int32
+	StatsdTCPIdleTimeout    int32
+
+	// log tcp listener, with optional tls. port 0 to disable
+	LogTCPPort     int32
+	LogTLSCertFile string
+	LogTLSKeyFile  string
+
+	// log unix socket listener, blank to disable. type can be unixgram or unix (stream)
+	LogUnixSocket     string
+	LogUnixSocketType string
+
+	// maximum size of log messages, on all log listeners
+	LogMaxMessageSize int32
+
+	// log record framing: newline or octet (octet-counted, allows multi-line messages)
+	LogFraming string
+
+	// window in seconds to save identical log messages as a single record, 0 to disable
+	LogDedupWindow int32
+
+	// per-app ingestion limits per second, 0 for no limit
+	RateLimitMetrics float64
+	RateLimitLogs    float64
+	RateLimitApps    map[string]RateLimitApp
+
+	// allow and deny lists of received metrics and logs, as globs or regular expressions between slashes.
+	// infos are matched against the info path without parameters, like conn.proj
+	AllowApps   []string
+	DenyApps    []string
+	AllowInfos  []string
+	DenyInfos   []string
+	AllowFields []string
+	DenyFields  []string
+
+	// maximum distinct values of each #param per collection per day, 0 for no limit.
+	// can be changed per collection parameter, with keys like "conn_proj#proj"
+	ParamCardinalityLimit  int32
+	ParamCardinalityLimits map[string]int32
+
+	// keys for signed udp packets. if AuthRequired, unsigned packets are dropped
+	AuthRequired bool
+	AuthKeys     []AuthKey
+
+	// info server tls listener if cert and key are set. if the client CA file is set, client certificates are required
+	InfoTLSCertFile     string
+	InfoTLSKeyFile      string
+	InfoTLSClientCAFile string
+
+	// info server authentication, if none is set all requests are allowed
+	AuthTokens []AuthToken
+	AuthUsers  []AuthUser
+
+	// user name header set by a trusted reverse proxy, only accepted from AuthProxyAddrs (ips or cidrs).
+	// the user must be on AuthUsers, the password hash is not used
+	AuthProxyHeader string
+	AuthProxyAddrs  []string
+
+	// statistics exported on the info server /metrics endpoint in the Prometheus format
+	PrometheusRules []infohttp.MetricsRule
+
+	// forwarding of received metrics to a Graphite Carbon server (host:port), blank to disable.
+	// protocol is plaintext or pickle. the template can use {app}, {info}, {field} and {type}
+	GraphiteAddr          string
+	GraphiteProtocol      string
+	GraphiteFlushInterval int32
+	GraphiteTemplate      string
+
+	// seconds to wait for the pending data to be saved and info requests in progress on shutdown
+	ShutdownTimeout int32
+
+	// maximum difference in seconds of client-supplied timestamps from the current time, 0 for no limit
+	MaxTimestampSkew int32
+
+	// full connection URI, or list of host:port seeds. If not set, MGOHost and MGOPort are used
+	MGOURI   string
+	MGOSeeds []string
+
 	MGOHost     string
 	MGOPort     string
 	MGOUsername string
 	MGOPassword string
 	MGODBName   string
+
+	// replica set name, authentication database and read preference
+	// (primary, primaryPreferred, secondary, secondaryPreferred or nearest), override the URI options
+	MGOReplicaSet     string
+	MGOAuthSource     string
+	MGOReadPreference string
+
+	// timeouts in seconds, 0 for 10 seconds to connect and 1 minute for socket operations
+	MGOConnectTimeout int32
+	MGOSocketTimeout  int32
+
+	// tls connection to MongoDB, with optional CA file to verify the server certificate
+	MGOTLS       bool
+	MGOTLSCAFile string
+}
+
+// Error statistics rule. Bucket is relative to the app, like "error.ct".
+// If MessageId is true, the log message id is added as parameter of the first info,
+// like "error#MESSAGEID.ct".
+type ErrorStatisticsRule struct {
+	Levels    []data.LogLevel
+	Bucket    string
+	MessageId bool
+}
+
+// Per-app rate limit override. 0 uses the default limit, negative is no limit.
+type RateLimitApp struct {
+	Metrics float64
+	Logs    float64
+}
+
+// Key for signed packets. Signed packets can only contain data of App.
+type AuthKey struct {
+	Id     string
+	Secret string
+	App    string
+}
+
+// Info server static api token. If Apps is not empty, only data of these apps can be retrieved.
+type AuthToken struct {
+	Token string
+	Apps  []string
+}
+
+// Info server HTTP basic user, with bcrypt password hash. If Apps is not empty, only data of these apps can be retrieved.
+type AuthUser struct {
+	Username     string
+	PasswordHash string
+	Apps         []string
 }
 
 func NewConfig() *Config {
 	c := Config{
-		StatsdPort:      8125,
-		LogPort:         8126,
-		ListenHost:      "localhost",
-		ErrorStatistics: true,
-		MGOHost:         "localhost",
-		MGOPort:         "27017",
-		MGOUsername:     "",
-		MGOPassword:     "",
-		MGODBName:       "appstatsd",
+		StatsdPort:              8125,
+		LogPort:                 8126,
+		InfoPort:                8127,
+		LoggingLevel:            "debug",
+		ListenHost:              "localhost",
+		ErrorStatistics:         true,
+		MaxTimestampSkew:        3600,
+		ShutdownTimeout:         10,
+		StatsdTCPMaxConnections: 100,
+		StatsdTCPIdleTimeout:    300,
+		LogUnixSocketType:       "unixgram",
+		LogMaxMessageSize:       65536,
+		LogFraming:              "newline",
+		GraphiteProtocol:        "plaintext",
+		GraphiteFlushInterval:   10,
+		GraphiteTemplate:        "appstatsd.{app}.{info}.{field}",
+		MGOHost:                 "localhost",
+		MGOPort:                 "27017",
+		MGOUsername:             "",
+		MGOPassword:             "",
+		MGODBName:               "appstatsd",
 	}
 	return &c
 }
 
+// Loads the configuration file into c. The error statistics rules of the file replace the default ones.
 func (c *Config) Load(configfile string) error {
 	_, err := toml.DecodeFile(configfile, c)
 	return err
 }
+
+// Sets the default values of settings that the configuration file replaces instead of merging,
+// if they were not loaded
+func (c *Config) SetDefaults() {
+	// the toml decoder reuses the capacity of an existing slice, so the defaults
+	// cannot be set on NewConfig without the loaded rules inheriting their fields
+	if len(c.ErrorStatisticsRules) == 0 {
+		c.ErrorStatisticsRules = []ErrorStatisticsRule{
+			{Levels: []data.LogLevel{data.CRITICAL, data.ERROR}, Bucket: "error.ct"},
+			{Levels: []data.LogLevel{data.WARNING}, Bucket: "error.wct"},
+		}
+	}
+}
+
+// Checks the configuration values
+func (c *Config) Validate() error {
+	var errs []string
+	addErr := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, err := logging.LogLevel(c.LoggingLevel); err != nil {
+		addErr("logginglevel must be critical, error, warning, notice, info or debug, got %q", c.LoggingLevel)
+	}
+
+	// ports, 0 disables the optional listeners
+	if c.StatsdPort < 1 || c.StatsdPort > 65535 {
+		addErr("statsdport must be between 1 and 65535, got %d", c.StatsdPort)
+	}
+	if c.LogPort < 1 || c.LogPort > 65535 {
+		addErr("logport must be between 1 and 65535, got %d", c.LogPort)
+	}
+	if c.InfoPort < 1 || c.InfoPort > 65535 {
+		addErr("infoport must be between 1 and 65535, got %d", c.InfoPort)
+	}
+	for name, port := range map[string]int32{"syslogport": c.SyslogPort, "statsdtcpport": c.StatsdTCPPort, "logtcpport": c.LogTCPPort} {
+		if port < 0 || port > 65535 {
+			addErr("%s must be between 0 and 65535, got %d", name, port)
+		}
+	}
+
+	if (c.LogTLSCertFile == "") != (c.LogTLSKeyFile == "") {
+		addErr("logtlscertfile and logtlskeyfile must be set together")
+	}
+	if (c.InfoTLSCertFile == "") != (c.InfoTLSKeyFile == "") {
+		addErr("infotlscertfile and infotlskeyfile must be set together")
+	}
+	if c.InfoTLSClientCAFile != "" && c.InfoTLSCertFile == "" {
+		addErr("infotlsclientcafile requires infotlscertfile and infotlskeyfile")
+	}
+	if c.LogUnixSocketType != "unixgram" && c.LogUnixSocketType != "unix" {
+		addErr("logunixsockettype must be unixgram or unix, got %q", c.LogUnixSocketType)
+	}
+	if c.LogFraming != "newline" && c.LogFraming != "octet" {
+		addErr("logframing must be newline or octet, got %q", c.LogFraming)
+	}
+	if c.LogMaxMessageSize < 1 {
+		addErr("logmaxmessagesize must be greater than 0, got %d", c.LogMaxMessageSize)
+	}
+
+	for name, value := range map[string]int32{
+		"statsdtcpmaxconnections": c.StatsdTCPMaxConnections,
+		"statsdtcpidletimeout":    c.StatsdTCPIdleTimeout,
+		"logdedupwindow":          c.LogDedupWindow,
+		"paramcardinalitylimit":   c.ParamCardinalityLimit,
+		"maxtimestampskew":        c.MaxTimestampSkew,
+	} {
+		if value < 0 {
+			addErr("%s cannot be negative, got %d", name, value)
+		}
+	}
+	if c.ShutdownTimeout < 1 {
+		addErr("shutdowntimeout must be greater than 0, got %d", c.ShutdownTimeout)
+	}
+	if c.RateLimitMetrics < 0 || c.RateLimitLogs < 0 {
+		addErr("ratelimitmetrics and ratelimitlogs cannot be negative")
+	}
+
+	for i, rule := range c.ErrorStatisticsRules {
+		if rule.Bucket == "" {
+			addErr("errorstatisticsrules %d: bucket is required", i+1)
+		}
+		for _, level := range rule.Levels {
+			if level < data.CRITICAL || level > data.DEBUG {
+				addErr("errorstatisticsrules %d: invalid level %d", i+1, level)
+			}
+		}
+	}
+
+	if _, err := NewIngestFilter(c); err != nil {
+		addErr("%s", err)
+	}
+
+	keyids := make(map[string]bool)
+	for i, key := range c.AuthKeys {
+		if key.Id == "" || key.Secret == "" || key.App == "" {
+			addErr("authkeys %d: id, secret and app are required", i+1)
+		} else if keyids[key.Id] {
+			addErr("authkeys %d: duplicated id %q", i+1, key.Id)
+		}
+		keyids[key.Id] = true
+	}
+	if c.AuthRequired && len(c.AuthKeys) == 0 {
+		addErr("authrequired is set but no authkeys are configured")
+	}
+	if c.AuthRequired {
+		// only the udp statsd and log listeners check signatures
+		for name, enabled := range map[string]bool{
+			"statsdtcpport": c.StatsdTCPPort != 0,
+			"logtcpport":    c.LogTCPPort != 0,
+			"logunixsocket": c.LogUnixSocket != "",
+			"syslogport":    c.SyslogPort != 0,
+		} {
+			if enabled {
+				addErr("authrequired cannot be used with %s, the listener does not check signatures", name)
+			}
+		}
+	}
+
+	for i, token := range c.AuthTokens {
+		if token.Token == "" {
+			addErr("authtokens %d: token is required", i+1)
+		}
+	}
+	for i, user := range c.AuthUsers {
+		if user.Username == "" {
+			addErr("authusers %d: username is required", i+1)
+		}
+	}
+	if c.AuthProxyHeader != "" && len(c.AuthProxyAddrs) == 0 {
+		addErr("authproxyheader requires authproxyaddrs")
+	}
+	for _, addr := range c.AuthProxyAddrs {
+		if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+			addErr("authproxyaddrs must contain ips or cidrs, got %q", addr)
+		}
+	}
+
+	metricnames := make(map[string]bool)
+	for i, rule := range c.PrometheusRules {
+		if !data.ValidateValueName(rule.Process) {
+			addErr("prometheusrules %d: invalid process %q", i+1, rule.Process)
+		}
+		if len(rule.Data) == 0 {
+			addErr("prometheusrules %d: data is required", i+1)
+		}
+		if rule.Period != "" && rule.Period != "day" && rule.Period != "hour" && rule.Period != "minute" {
+			addErr("prometheusrules %d: period must be day, hour or minute, got %q", i+1, rule.Period)
+		}
+		if !prometheusNameRE.MatchString(rule.MetricName()) {
+			addErr("prometheusrules %d: invalid metric name %q", i+1, rule.MetricName())
+		} else if metricnames[rule.MetricName()] {
+			addErr("prometheusrules %d: duplicated metric name %q", i+1, rule.MetricName())
+		}
+		metricnames[rule.MetricName()] = true
+		labelnames := make(map[string]bool)
+		for param, label := range rule.Labels {
+			if !data.ValidateName(param) {
+				addErr("prometheusrules %d: invalid parameter %q", i+1, param)
+			}
+			if !prometheusLabelRE.MatchString(label) || strings.HasPrefix(label, "__") || (rule.App && label == "app") {
+				addErr("prometheusrules %d: invalid label name %q", i+1, label)
+			} else if labelnames[label] {
+				// prometheus rejects the whole scrape with duplicated labels
+				addErr("prometheusrules %d: label name %q used by more than one parameter", i+1, label)
+			}
+			labelnames[label] = true
+		}
+	}
+
+	if c.GraphiteAddr != "" {
+		if _, _, err := net.SplitHostPort(c.GraphiteAddr); err != nil {
+			addErr("graphiteaddr must be host:port, got %q", c.GraphiteAddr)
+		}
+		if c.GraphiteProtocol != "plaintext" && c.GraphiteProtocol != "pickle" {
+			addErr("graphiteprotocol must be plaintext or pickle, got %q", c.GraphiteProtocol)
+		}
+		if c.GraphiteFlushInterval < 1 {
+			addErr("graphiteflushinterval must be greater than 0, got %d", c.GraphiteFlushInterval)
+		}
+		if !strings.Contains(c.GraphiteTemplate, "{field}") {
+			addErr("graphitetemplate must contain {field}, got %q", c.GraphiteTemplate)
+		}
+	}
+
+	errs = append(errs, dbConfigFrom(c).Validate()...)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"github.com/RangelReale/appstatsd/infohttp"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	if err := NewConfig().Validate(); err != nil {
+		t.Fatalf("default configuration should be valid: %s", err)
+	}
+
+	c := NewConfig()
+	c.StatsdPort = 0
+	c.LogFraming = "lines"
+	c.LoggingLevel = "verbose"
+	c.AuthRequired = true
+	c.DenyApps = []string{"/[/"}
+	c.MGOReadPreference = "secondaries"
+	c.PrometheusRules = []infohttp.MetricsRule{{Process: "conn", Data: []string{"c_ct"}, Labels: map[string]string{"conn": "1project"}}}
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("invalid configuration should return an error")
+	}
+	for _, name := range []string{"statsdport", "logframing", "logginglevel", "authrequired", "mgoreadpreference", "/[/", "prometheusrules"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error should mention %s: %s", name, err)
+		}
+	}
+}
+
+func TestConfigValidateAuthRequired(t *testing.T) {
+	c := NewConfig()
+	c.AuthRequired = true
+	c.AuthKeys = []AuthKey{{Id: "app1key", Secret: "secret", App: "app1"}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("authrequired with only udp listeners should be valid: %s", err)
+	}
+
+	c.StatsdTCPPort = 8125
+	c.LogTCPPort = 8128
+	c.LogUnixSocket = "/tmp/appstatsd-log.sock"
+	c.SyslogPort = 5514
+
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("authrequired with unauthenticated listeners should return an error")
+	}
+	for _, name := range []string{"statsdtcpport", "logtcpport", "logunixsocket", "syslogport"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("error should mention %s: %s", name, err)
+		}
+	}
+}
+
+func TestConfigLoadErrorStatisticsRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "appstatsd-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("[[errorstatisticsrules]]\nlevels = [1, 2]\n")
+	f.Close()
+
+	c := NewConfig()
+	if err := c.Load(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	c.SetDefaults()
+	if len(c.ErrorStatisticsRules) != 1 {
+		t.Fatalf("loaded rules should replace the defaults, got %+v", c.ErrorStatisticsRules)
+	}
+	err = c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "bucket is required") {
+		t.Errorf("rule without bucket should be invalid, got %v", err)
+	}
+
+	c = NewConfig()
+	c.SetDefaults()
+	if len(c.ErrorStatisticsRules) != 2 || c.ErrorStatisticsRules[0].Bucket != "error.ct" {
+		t.Errorf("default rules not set: %+v", c.ErrorStatisticsRules)
+	}
+}
+
+func TestConfigValidatePrometheusLabels(t *testing.T) {
+	c := NewConfig()
+	c.PrometheusRules = []infohttp.MetricsRule{{Process: "conn", Data: []string{"c_ct"}, Labels: map[string]string{"conn": "project", "conn1": "host"}}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("distinct labels should be valid: %s", err)
+	}
+
+	c.PrometheusRules[0].Labels = map[string]string{"conn": "x", "conn1": "x"}
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), `label name "x"`) {
+		t.Errorf("duplicated label name should be invalid, got %v", err)
+	}
+}
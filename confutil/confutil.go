@@ -0,0 +1,153 @@
+// Package confutil overrides configuration fields from environment variables and command line flags,
+// shared by appstatsd and appstatsd-info.
+//
+// Only fields of type string, bool, integer, float and []string can be overridden.
+// Each field uses the environment variable PREFIX + the upper case field name, like APPSTATSD_STATSDPORT,
+// and the flag with the lower case field name, like -statsdport. []string values are comma-separated.
+package confutil
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Environment variable prefix used by both binaries
+const EnvPrefix = "APPSTATSD_"
+
+// Sets the fields of the struct pointed by config from the environment variables
+func ApplyEnv(config interface{}, prefix string) error {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !supported(field) {
+			continue
+		}
+		envname := prefix + strings.ToUpper(field.Name)
+		if value, ok := os.LookupEnv(envname); ok {
+			if err := setField(v.Field(i), value); err != nil {
+				return fmt.Errorf("Invalid value for environment variable %s: %s", envname, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Registers a flag for each field of the struct pointed by config, with the current values as defaults.
+// Must be called before fs.Parse.
+func AddFlags(fs *flag.FlagSet, config interface{}) {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !supported(field) {
+			continue
+		}
+		fv := &flagValue{value: formatField(v.Field(i)), isbool: field.Type.Kind() == reflect.Bool}
+		fs.Var(fv, strings.ToLower(field.Name), fmt.Sprintf("override %s configuration", field.Name))
+	}
+}
+
+// Sets the fields of the struct pointed by config from the flags set on the command line.
+// Must be called after fs.Parse.
+func ApplyFlags(fs *flag.FlagSet, config interface{}) error {
+	v := reflect.ValueOf(config).Elem()
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if _, ok := f.Value.(*flagValue); !ok {
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if strings.ToLower(v.Type().Field(i).Name) == f.Name {
+				if serr := setField(v.Field(i), f.Value.String()); serr != nil {
+					err = fmt.Errorf("Invalid value for flag -%s: %s", f.Name, serr)
+				}
+				return
+			}
+		}
+	})
+	return err
+}
+
+// raw flag value, converted when applied
+type flagValue struct {
+	value  string
+	isbool bool
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *flagValue) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+// Allows bool flags without value, like -authrequired
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isbool
+}
+
+func supported(field reflect.StructField) bool {
+	if field.PkgPath != "" {
+		// unexported
+		return false
+	}
+	switch field.Type.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int32, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return field.Type.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+func setField(fv reflect.Value, value string) error {
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		fv.Set(reflect.ValueOf(list).Convert(fv.Type()))
+	}
+	return nil
+}
+
+func formatField(fv reflect.Value) string {
+	if fv.Kind() == reflect.Slice {
+		return strings.Join(fv.Convert(reflect.TypeOf([]string{})).Interface().([]string), ",")
+	}
+	return fmt.Sprint(fv.Interface())
+}
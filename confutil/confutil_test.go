@@ -0,0 +1,88 @@
+package confutil
+
+import (
+	"flag"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type testConfig struct {
+	Port    int32
+	Host    string
+	Enabled bool
+	Rate    float64
+	Apps    []string
+	Limits  map[string]int32
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	c := &testConfig{Port: 8125, Host: "localhost", Enabled: true}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	AddFlags(fs, c)
+	if fs.Lookup("limits") != nil {
+		t.Error("maps should not have flags")
+	}
+	if err := fs.Parse([]string{"-host", "flaghost", "-apps", "app1, app2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TEST_PORT", "9000")
+	os.Setenv("TEST_HOST", "envhost")
+	os.Setenv("TEST_ENABLED", "false")
+	defer os.Unsetenv("TEST_PORT")
+	defer os.Unsetenv("TEST_HOST")
+	defer os.Unsetenv("TEST_ENABLED")
+
+	if err := ApplyEnv(c, "TEST_"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyFlags(fs, c); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &testConfig{Port: 9000, Host: "flaghost", Enabled: false, Apps: []string{"app1", "app2"}}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %+v, got %+v", expected, c)
+	}
+
+	os.Setenv("TEST_PORT", "x")
+	if err := ApplyEnv(c, "TEST_"); err == nil {
+		t.Error("invalid value should return an error")
+	}
+}
+
+func TestBoolFlagWithoutValue(t *testing.T) {
+	c := &testConfig{Port: 8125}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	AddFlags(fs, c)
+	if err := fs.Parse([]string{"-enabled", "-port", "9000", "arg1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyFlags(fs, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.Enabled || c.Port != 9000 {
+		t.Errorf("expected enabled and port 9000, got %+v", c)
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "arg1" {
+		t.Errorf("bool flag should not consume arguments, got %v", fs.Args())
+	}
+
+	// the explicit form still works
+	c.Enabled = true
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	AddFlags(fs, c)
+	if err := fs.Parse([]string{"-enabled=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ApplyFlags(fs, c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Enabled {
+		t.Error("expected enabled false")
+	}
+}
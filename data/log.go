@@ -1,6 +1,7 @@
 package data
 
 import (
+	"gopkg.in/mgo.v2/bson"
 	"time"
 )
 
@@ -16,9 +17,17 @@ const (
 )
 
 type LogData struct {
-	Date      time.Time `json:"date" bson:"dt"`
-	Level     LogLevel  `json:"level" bson:"lv"`
-	App       string    `json:"app" bson:"app,omitempty"`
-	MessageId string    `json:"mid,omitempty" bson:"mid,omitempty"`
-	Message   string    `json:"msg" bson:"m"`
+	Id        bson.ObjectId `json:"-" bson:"_id,omitempty"`
+	Date      time.Time     `json:"date" bson:"dt"`
+	Level     LogLevel      `json:"level" bson:"lv"`
+	App       string        `json:"app" bson:"app,omitempty"`
+	MessageId string        `json:"mid,omitempty" bson:"mid,omitempty"`
+	Message   string        `json:"msg" bson:"m"`
+
+	// structured key/value fields
+	Fields map[string]interface{} `json:"fields,omitempty" bson:"fields,omitempty"`
+
+	// if deduplicated, the total number of occurrences and date of the last one
+	RepeatCount int        `json:"repeat,omitempty" bson:"rc,omitempty"`
+	LastDate    *time.Time `json:"lastdate,omitempty" bson:"ldt,omitempty"`
 }
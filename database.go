@@ -3,24 +3,36 @@ package main
 import (
 	"fmt"
 	"github.com/RangelReale/appstatsd/data"
+	"github.com/RangelReale/appstatsd/dbconn"
 	"github.com/RangelReale/gostatsd/statsd"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"strings"
+	"sync"
 	"time"
 )
 
 var (
+	// shared by ingest and info, guarded by dbMu
 	dbsession    *mgo.Session
 	dbdb         *mgo.Database
 	dblogc       *mgo.Collection
+	dbMu         sync.Mutex
 	DatabaseChan chan DBMessage
+
+	// closed to stop ServerDatabase after saving the queued messages
+	dbStop = make(chan struct{})
+	// closed when ServerDatabase stopped
+	dbStopped = make(chan struct{})
 )
 
 // message to send on DatabaseChan to notify of new data
 type DBMessage struct {
 	metrics *statsd.Metric
 	log     *data.LogData
+	date    time.Time // date of the event, current time if zero
+	system  bool      // internal statistics, app can start with underline
+	samples int64     // number of timer or gauge values aggregated in the value, 1 if zero
 }
 
 func init() {
@@ -28,36 +40,139 @@ func init() {
 }
 
 func ServerDatabase() {
+	defer close(dbStopped)
+
 	dbConnect()
 
-	for proc := range DatabaseChan {
-		if err := dbConnect(); err != nil {
-			log.Error("Could not connect to database: %s", err)
-			continue
+	for {
+		select {
+		case proc := <-DatabaseChan:
+			dbHandleMessage(proc)
+		case <-dbStop:
+			// save queued messages and close the session
+			for {
+				select {
+				case proc := <-DatabaseChan:
+					dbHandleMessage(proc)
+				default:
+					dbClose()
+					return
+				}
+			}
 		}
+	}
+}
+
+func dbHandleMessage(proc DBMessage) {
+	if err := dbConnect(); err != nil {
+		log.Error("Could not connect to database: %s", err)
+		SystemCount(systemDBErrors, 1)
+		return
+	}
+
+	if proc.metrics != nil {
+		dbHandleMetrics(proc.metrics, proc.date, proc.system, proc.samples)
+	}
+
+	if proc.log != nil {
+		dbHandleLog(proc.log)
+	}
+}
+
+// repeated log message being deduplicated
+type dbLogDedupEntry struct {
+	id    bson.ObjectId
+	start time.Time
+	count int
+}
+
+// Repeated log messages being deduplicated, by app, level, message id and message
+type dbLogDedupCache struct {
+	entries   map[string]*dbLogDedupEntry
+	lastpurge time.Time
+}
+
+var dbLogDedup = newDBLogDedupCache()
+
+func newDBLogDedupCache() *dbLogDedupCache {
+	return &dbLogDedupCache{entries: make(map[string]*dbLogDedupEntry)}
+}
+
+// Saves the message with insert, or if an identical message was saved less than window ago,
+// increments its repeat count with update. If update returns mgo.ErrNotFound, the first
+// message was removed, and the message is inserted again starting a new count.
+func (d *dbLogDedupCache) Save(l *data.LogData, window time.Duration, now time.Time,
+	update func(e *dbLogDedupEntry) error, insert func() error) error {
+	if window <= 0 {
+		return insert()
+	}
 
-		if proc.metrics != nil {
-			dbHandleMetrics(proc.metrics)
+	// purge expired entries once per window
+	if now.Sub(d.lastpurge) >= window {
+		for k, e := range d.entries {
+			if now.Sub(e.start) >= window {
+				delete(d.entries, k)
+			}
 		}
+		d.lastpurge = now
+	}
 
-		if proc.log != nil {
-			dblogc.Insert(proc.log)
+	key := fmt.Sprintf("%s\x00%d\x00%s\x00%s", l.App, l.Level, l.MessageId, l.Message)
+	if e, ok := d.entries[key]; ok && now.Sub(e.start) < window {
+		e.count++
+		err := update(e)
+		if err != mgo.ErrNotFound {
+			return err
 		}
+		// first record was removed, insert a new one
+	}
+
+	if err := insert(); err != nil {
+		return err
+	}
+	d.entries[key] = &dbLogDedupEntry{id: l.Id, start: now, count: 1}
+	return nil
+}
+
+// save log message. If deduplication is enabled, identical messages
+// inside the window only update the repeat count and last date of the first one.
+// The repeats are not sent to the log streams, which only follow new records.
+func dbHandleLog(l *data.LogData) {
+	configMu.RLock()
+	window := time.Duration(Configuration.LogDedupWindow) * time.Second
+	configMu.RUnlock()
+
+	err := dbLogDedup.Save(l, window, time.Now(), func(e *dbLogDedupEntry) error {
+		return dblogc.UpdateId(e.id, bson.M{"$set": bson.M{"rc": e.count, "ldt": l.Date}})
+	}, func() error {
+		// generate id here so ids follow insertion order, log streaming depends on it
+		l.Id = bson.NewObjectId()
+		return dblogc.Insert(l)
+	})
+	if err != nil {
+		log.Error("Error saving log record: %s", err)
+		SystemCount(systemDBErrors, 1)
 	}
 }
 
 // handle metrics received from statsd
 // bucket name must be in this format:
 // appname.info1#param1#param2.info2#param1.infoX.field
-// data is saved for day, hour, and 15 minute intervals
-func dbHandleMetrics(m *statsd.Metric) {
+// data is saved for day, hour, and 15 minute intervals of date
+// only system (internal) metrics can have app names starting with underline
+// samples is the number of timer or gauge values aggregated in the value
+func dbHandleMetrics(m *statsd.Metric, date time.Time, system bool, samples int64) {
+	if samples < 1 {
+		samples = 1
+	}
+
 	values := strings.Split(m.Bucket, ".")
 	if len(values) < 3 {
-		log.Error("Invalid bucket name - at least 3 items dot-separated items are required: %s", m.Bucket)
+		dbRejectMetric("Invalid bucket name - at least 3 items dot-separated items are required: %s", m.Bucket)
 		return
 	}
-	if strings.HasPrefix(m.Bucket, "_") {
-		log.Error("Invalid bucket name - cannot start with underline: %s", m.Bucket)
+	if !system && strings.HasPrefix(m.Bucket, "_") {
+		dbRejectMetric("Invalid bucket name - cannot start with underline: %s", m.Bucket)
 		return
 	}
 
@@ -68,20 +183,27 @@ func dbHandleMetrics(m *statsd.Metric) {
 	name := values[len(values)-1]
 
 	// sanitization
-	if !data.ValidateName(app) {
-		log.Error("Invalid bucket name - name not validated: %s", app)
+	vapp := app
+	if system {
+		vapp = strings.TrimPrefix(app, "_")
+	}
+	if !data.ValidateName(vapp) {
+		dbRejectMetric("Invalid bucket name - name not validated: %s", app)
 		return
 	}
 
 	if !data.ValidateValueName(name) {
-		log.Error("Invalid bucket name - name not validated: %s", name)
+		dbRejectMetric("Invalid bucket name - name not validated: %s", name)
 		return
 	}
 
 	// remove first and last item
 	values = values[1 : len(values)-1]
 
-	tm := time.Now().UTC()
+	if date.IsZero() {
+		date = time.Now()
+	}
+	tm := date.UTC()
 	// 15 minute aggregation
 	minute := int(tm.Minute()/15.0) * 15
 
@@ -100,22 +222,22 @@ func dbHandleMetrics(m *statsd.Metric) {
 		idata = &bson.M{
 			"$inc": bson.M{
 				fmt.Sprintf("_dy.t_%s", name):                                  m.Value,
-				fmt.Sprintf("_dy.tc_%s", name):                                 1,
+				fmt.Sprintf("_dy.tc_%s", name):                                 samples,
 				fmt.Sprintf("_hr.h_%d.t_%s", tm.Hour(), name):                  m.Value,
-				fmt.Sprintf("_hr.h_%d.tc_%s", tm.Hour(), name):                 1,
+				fmt.Sprintf("_hr.h_%d.tc_%s", tm.Hour(), name):                 samples,
 				fmt.Sprintf("_hr.h_%d.mn.m_%d.t_%s", tm.Hour(), minute, name):  m.Value,
-				fmt.Sprintf("_hr.h_%d.mn.m_%d.tc_%s", tm.Hour(), minute, name): 1,
+				fmt.Sprintf("_hr.h_%d.mn.m_%d.tc_%s", tm.Hour(), minute, name): samples,
 			},
 		}
 	case statsd.GAUGE:
 		idata = &bson.M{
 			"$inc": bson.M{
 				fmt.Sprintf("_dy.g_%s", name):                                  m.Value,
-				fmt.Sprintf("_dy.gc_%s", name):                                 1,
+				fmt.Sprintf("_dy.gc_%s", name):                                 samples,
 				fmt.Sprintf("_hr.h_%d.g_%s", tm.Hour(), name):                  m.Value,
-				fmt.Sprintf("_hr.h_%d.gc_%s", tm.Hour(), name):                 1,
+				fmt.Sprintf("_hr.h_%d.gc_%s", tm.Hour(), name):                 samples,
 				fmt.Sprintf("_hr.h_%d.mn.m_%d.g_%s", tm.Hour(), minute, name):  m.Value,
-				fmt.Sprintf("_hr.h_%d.mn.m_%d.gc_%s", tm.Hour(), minute, name): 1,
+				fmt.Sprintf("_hr.h_%d.mn.m_%d.gc_%s", tm.Hour(), minute, name): samples,
 			},
 		}
 	}
@@ -136,19 +258,19 @@ func dbHandleMetrics(m *statsd.Metric) {
 		for _, iv := range values {
 			info := strings.Split(iv, "#")
 			if strings.HasPrefix(info[0], "_") {
-				log.Error("Invalid bucket name - info cannot start with underline: %s", info[0])
+				dbRejectMetric("Invalid bucket name - info cannot start with underline: %s", info[0])
 				return
 			}
 
 			// sanitize
 			if !data.ValidateName(info[0]) {
-				log.Error("Invalid bucket name - name not validated: %s", info[0])
+				dbRejectMetric("Invalid bucket name - name not validated: %s", info[0])
 				return
 			}
 
 			c_base = c_base + "_" + info[0]
 			if len(c_base) == 0 {
-				log.Error("Invalid bucket name - info cannot be blank: %s", m.Bucket)
+				dbRejectMetric("Invalid bucket name - info cannot be blank: %s", m.Bucket)
 				return
 			}
 
@@ -169,10 +291,13 @@ func dbHandleMetrics(m *statsd.Metric) {
 
 					// sanitize
 					if !data.ValidateName(pname) {
-						log.Error("Invalid param name - name not validated: %s", pname)
+						dbRejectMetric("Invalid param name - name not validated: %s", pname)
 						return
 					}
 
+					// limit distinct values of parameter
+					rv = dbCardinalityCheck(c, pname, rv, baseq["_dt"].(string))
+
 					// add parameter to queries
 					baseq[pname] = rv
 					baseqapp[pname] = rv
@@ -180,43 +305,47 @@ func dbHandleMetrics(m *statsd.Metric) {
 			}
 
 			// general
+			start := time.Now()
 			_, err := c.Upsert(baseq, *idata)
+			SystemTiming(systemDBUpsert, time.Since(start))
 			if err != nil {
 				log.Error("Error saving log record: %s", err)
+				SystemCount(systemDBErrors, 1)
 			}
 
 			// by app
 			if app != "" {
+				start = time.Now()
 				_, err = capp.Upsert(baseqapp, *idata)
+				SystemTiming(systemDBUpsert, time.Since(start))
 				if err != nil {
 					log.Error("Error saving connection app record: %s", err)
+					SystemCount(systemDBErrors, 1)
 				}
 			}
 		}
 	}
 }
 
+// logs and counts a rejected metric
+func dbRejectMetric(format string, args ...interface{}) {
+	log.Error(format, args...)
+	SystemCount(systemDBInvalid, 1)
+}
+
 func dbConnect() error {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
 	if dbsession != nil {
 		return nil
 	}
 
-	log.Debug("Connecting to database")
-
-	var mgourl string
-	if Configuration.MGOUsername != "" {
-		mgourl = fmt.Sprintf("mongodb://%s:%s@%s:%s/%s",
-			Configuration.MGOUsername, Configuration.MGOPassword,
-			Configuration.MGOHost, Configuration.MGOPort,
-			Configuration.MGODBName)
-	} else {
-		mgourl = fmt.Sprintf("mongodb://%s:%s/%s",
-			Configuration.MGOHost, Configuration.MGOPort,
-			Configuration.MGODBName)
-	}
+	dbconfig := dbConfig()
+	log.Debug("Connecting to database %s", dbconfig)
 
 	var err error
-	dbsession, err = mgo.Dial(mgourl)
+	dbsession, err = dbconn.Dial(dbconfig)
 	if err == nil {
 		dbdb = dbsession.DB(Configuration.MGODBName)
 		dblogc = dbdb.C("log")
@@ -226,13 +355,153 @@ func dbConnect() error {
 	return err
 }
 
+func dbConfig() *dbconn.Config {
+	return dbConfigFrom(Configuration)
+}
+
+func dbConfigFrom(c *Config) *dbconn.Config {
+	return &dbconn.Config{
+		URI:            c.MGOURI,
+		Seeds:          c.MGOSeeds,
+		Host:           c.MGOHost,
+		Port:           c.MGOPort,
+		Username:       c.MGOUsername,
+		Password:       c.MGOPassword,
+		Database:       c.MGODBName,
+		ReplicaSet:     c.MGOReplicaSet,
+		AuthSource:     c.MGOAuthSource,
+		ReadPreference: c.MGOReadPreference,
+		ConnectTimeout: time.Duration(c.MGOConnectTimeout) * time.Second,
+		SocketTimeout:  time.Duration(c.MGOSocketTimeout) * time.Second,
+		TLS:            c.MGOTLS,
+		TLSCAFile:      c.MGOTLSCAFile,
+	}
+}
+
 func DBConnectClone() (*mgo.Session, error) {
+	if err := dbConnect(); err != nil {
+		return nil, err
+	}
+
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
 	if dbsession == nil {
-		err := dbConnect()
-		if err != nil {
-			return nil, err
+		return nil, fmt.Errorf("database closed")
+	}
+	return dbsession.Clone(), nil
+}
+
+func dbClose() {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	if dbsession != nil {
+		dbsession.Close()
+		dbsession = nil
+	}
+}
+
+// parameter value used when the cardinality limit is reached
+const dbCardinalityOther = "__other__"
+
+// distinct parameter values of a collection on a day
+type dbCardinalityEntry struct {
+	day    string
+	values map[string]bool
+	warned bool
+}
+
+// Distinct parameter values per collection, parameter and day
+type dbCardinalityCache struct {
+	entries map[string]*dbCardinalityEntry
+}
+
+var dbCardinality = newDBCardinalityCache()
+
+func newDBCardinalityCache() *dbCardinalityCache {
+	return &dbCardinalityCache{entries: make(map[string]*dbCardinalityEntry)}
+}
+
+// Returns the limit of distinct values of a collection parameter per day, 0 for no limit
+func dbCardinalityLimit(collection string, pname string) int {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	if limit, ok := Configuration.ParamCardinalityLimits[strings.TrimPrefix(collection, "stat_")+"#"+pname]; ok {
+		return int(limit)
+	}
+	return int(Configuration.ParamCardinalityLimit)
+}
+
+// Checks the number of distinct values of a parameter on the collection for the day.
+// Values beyond the limit are replaced by "__other__", and counted in the
+// _system.cardinality#COLLECTION:PARAM.overflow internal counter.
+func dbCardinalityCheck(c *mgo.Collection, pname string, value string, day string) string {
+	limit := dbCardinalityLimit(c.Name, pname)
+	if limit <= 0 {
+		return value
+	}
+
+	configMu.RLock()
+	maxskew := Configuration.MaxTimestampSkew
+	configMu.RUnlock()
+	oldest := time.Now().UTC().Add(-24*time.Hour - time.Duration(maxskew)*time.Second).Format("2006-01-02")
+
+	ret, overflow := dbCardinality.Check(c.Name, pname, value, day, limit, oldest, func() ([]string, error) {
+		var values []string
+		err := c.Find(bson.M{"_dt": day, pname: bson.M{"$exists": true}}).Distinct(pname, &values)
+		return values, err
+	})
+	if overflow {
+		SystemCount("_system.cardinality#"+SystemParam(c.Name+":"+pname)+".overflow", 1)
+	}
+	return ret
+}
+
+// Returns value if it is one of the first limit distinct values of the parameter on the day,
+// or "__other__" and true.
+// The first check of a day calls load to get the values already saved, and removes the days before oldest,
+// which are not expected to receive data anymore.
+func (cc *dbCardinalityCache) Check(collection string, pname string, value string, day string, limit int,
+	oldest string, load func() ([]string, error)) (string, bool) {
+	key := collection + "#" + pname + "@" + day
+	e, ok := cc.entries[key]
+	if !ok {
+		for k, oe := range cc.entries {
+			if oe.day < oldest {
+				delete(cc.entries, k)
+			}
 		}
+
+		// load values already saved
+		e = &dbCardinalityEntry{day: day, values: make(map[string]bool)}
+		if load != nil {
+			values, err := load()
+			if err != nil {
+				log.Error("Error loading parameter values of %s.%s: %s", collection, pname, err)
+				SystemCount(systemDBErrors, 1)
+			}
+			for _, v := range values {
+				if v != dbCardinalityOther {
+					e.values[v] = true
+				}
+			}
+		}
+		cc.entries[key] = e
 	}
 
-	return dbsession.Clone(), nil
+	if e.values[value] {
+		return value, false
+	}
+	if len(e.values) < limit {
+		e.values[value] = true
+		return value, false
+	}
+
+	if !e.warned {
+		log.Warning("Cardinality limit of %d reached for parameter %s of %s on %s", limit, pname, collection, day)
+		e.warned = true
+	}
+	return dbCardinalityOther, true
 }
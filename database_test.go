@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/RangelReale/appstatsd/data"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"testing"
+	"time"
+)
+
+func TestDBCardinalityCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		saved    []string
+		values   []string
+		expected []string
+	}{
+		{"limit", nil,
+			[]string{"p1", "p2", "p3", "p1", "p4"},
+			[]string{"p1", "p2", "__other__", "p1", "__other__"}},
+		{"reload", []string{"p1", "__other__"},
+			[]string{"p2", "p3", "p1"},
+			[]string{"p2", "__other__", "p1"}},
+		{"reload full", []string{"p1", "p2"},
+			[]string{"p3", "p2"},
+			[]string{"__other__", "p2"}},
+	}
+
+	for _, tt := range tests {
+		cc := newDBCardinalityCache()
+		loads := 0
+		load := func() ([]string, error) {
+			loads++
+			return tt.saved, nil
+		}
+		for i, v := range tt.values {
+			if r, _ := cc.Check("stat_conn", "conn", v, "2014-01-02", 2, "2014-01-01", load); r != tt.expected[i] {
+				t.Errorf("%s: value %d: expected %s, got %s", tt.name, i, tt.expected[i], r)
+			}
+		}
+		if loads != 1 {
+			t.Errorf("%s: saved values should be loaded once per day, loaded %d times", tt.name, loads)
+		}
+	}
+}
+
+func TestDBCardinalityCacheDayRollover(t *testing.T) {
+	cc := newDBCardinalityCache()
+	cc.Check("stat_conn", "conn", "p1", "2014-01-01", 1, "2014-01-01", nil)
+	if r, overflow := cc.Check("stat_conn", "conn", "p2", "2014-01-01", 1, "2014-01-01", nil); r != dbCardinalityOther || !overflow {
+		t.Errorf("expected %s, got %s", dbCardinalityOther, r)
+	}
+
+	// each day has its own limit, and days before oldest are removed
+	if r, _ := cc.Check("stat_conn", "conn", "p2", "2014-01-02", 1, "2014-01-02", nil); r != "p2" {
+		t.Errorf("new day should accept new values, got %s", r)
+	}
+	if _, ok := cc.entries["stat_conn#conn@2014-01-01"]; ok {
+		t.Error("days before oldest should be removed")
+	}
+	if len(cc.entries) != 1 {
+		t.Errorf("expected 1 entry, got %d", len(cc.entries))
+	}
+}
+
+func TestDBLogDedupCache(t *testing.T) {
+	d := newDBLogDedupCache()
+	window := time.Minute
+	start := time.Now()
+
+	var inserts, updates int
+	var updateErr error
+	var counts []int
+	save := func(msg string, now time.Time) {
+		l := &data.LogData{App: "app1", Level: data.ERROR, Message: msg}
+		err := d.Save(l, window, now, func(e *dbLogDedupEntry) error {
+			updates++
+			counts = append(counts, e.count)
+			return updateErr
+		}, func() error {
+			inserts++
+			l.Id = bson.NewObjectId()
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		msg      string
+		after    time.Duration
+		notfound bool
+		inserts  int
+		updates  int
+	}{
+		{"first", "error 1", 0, false, 1, 0},
+		{"repeat", "error 1", 10 * time.Second, false, 1, 1},
+		{"other message", "error 2", 20 * time.Second, false, 2, 1},
+		{"repeat again", "error 1", 30 * time.Second, false, 2, 2},
+		{"first removed", "error 1", 40 * time.Second, true, 3, 3},
+		{"repeat of new record", "error 1", 50 * time.Second, false, 3, 4},
+		{"window expired", "error 2", 90 * time.Second, false, 4, 4},
+	}
+	for _, tt := range tests {
+		updateErr = nil
+		if tt.notfound {
+			updateErr = mgo.ErrNotFound
+		}
+		save(tt.msg, start.Add(tt.after))
+		if inserts != tt.inserts || updates != tt.updates {
+			t.Errorf("%s: expected %d inserts and %d updates, got %d and %d", tt.name, tt.inserts, tt.updates, inserts, updates)
+		}
+	}
+
+	// the record inserted after the first was removed starts a new count
+	expected := []int{2, 3, 4, 2}
+	for i, c := range counts {
+		if i < len(expected) && c != expected[i] {
+			t.Errorf("update %d: expected repeat count %d, got %d", i+1, expected[i], c)
+		}
+	}
+
+	// without window all messages are inserted
+	inserts = 0
+	d.Save(&data.LogData{App: "app1", Message: "error 1"}, 0, start, nil, func() error {
+		inserts++
+		return nil
+	})
+	if inserts != 1 {
+		t.Error("messages should be inserted when deduplication is disabled")
+	}
+}
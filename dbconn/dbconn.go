@@ -0,0 +1,300 @@
+// Package dbconn connects to MongoDB using the connection settings shared by appstatsd and appstatsd-info.
+package dbconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gopkg.in/mgo.v2"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MongoDB connection settings
+type Config struct {
+	// full connection URI. If set, Host, Port, Seeds, Username and Password are not used
+	URI string
+
+	// list of host:port seeds. If empty, Host and Port are used
+	Seeds []string
+
+	Host     string
+	Port     string
+	Username string
+	Password string
+	Database string
+
+	// optional replica set name, authentication database and read preference
+	// (primary, primaryPreferred, secondary, secondaryPreferred or nearest).
+	// If set, they override the URI options
+	ReplicaSet     string
+	AuthSource     string
+	ReadPreference string
+
+	// 0 uses DefaultConnectTimeout and DefaultSocketTimeout
+	ConnectTimeout time.Duration
+	SocketTimeout  time.Duration
+
+	// use tls, verifying the server certificate with the CA certificates of TLSCAFile,
+	// or the system ones if blank
+	TLS       bool
+	TLSCAFile string
+}
+
+// Checks the connection settings, returning one message per invalid setting,
+// using the configuration file names
+func (c *Config) Validate() []string {
+	var errs []string
+	if c.URI == "" && len(c.Seeds) == 0 {
+		if c.Host == "" {
+			errs = append(errs, "mgohost is required if mgouri and mgoseeds are not set")
+		}
+		if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+			errs = append(errs, fmt.Sprintf("mgoport must be a port number, got %q", c.Port))
+		}
+	}
+	if c.URI != "" {
+		if _, err := url.Parse(c.URI); err != nil || !strings.HasPrefix(c.URI, "mongodb://") {
+			errs = append(errs, "mgouri must be a mongodb:// uri")
+		} else if _, _, err := c.parseURI(); err != nil {
+			errs = append(errs, fmt.Sprintf("mgouri: %s", err))
+		}
+	}
+	for _, seed := range c.Seeds {
+		if _, _, err := net.SplitHostPort(seed); err != nil {
+			errs = append(errs, fmt.Sprintf("mgoseeds must be host:port, got %q", seed))
+		}
+	}
+	if c.Database == "" {
+		errs = append(errs, "mgodbname is required")
+	}
+	if _, err := ParseReadPreference(c.ReadPreference); err != nil {
+		errs = append(errs, fmt.Sprintf("mgoreadpreference must be primary, primaryPreferred, secondary, secondaryPreferred or nearest, got %q", c.ReadPreference))
+	}
+	if c.ConnectTimeout < 0 || c.SocketTimeout < 0 {
+		errs = append(errs, "mgoconnecttimeout and mgosockettimeout cannot be negative")
+	}
+	if c.TLSCAFile != "" && !c.TLS {
+		errs = append(errs, "mgotlscafile is set but mgotls is false")
+	}
+	return errs
+}
+
+// Timeouts used when not set, the same used by mgo.Dial
+const (
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultSocketTimeout  = time.Minute
+	DefaultSyncTimeout    = time.Minute
+)
+
+// URI options handled by the driver, which are case sensitive
+var uriDriverOptions = map[string]bool{
+	"authSource":        true,
+	"authMechanism":     true,
+	"gssapiServiceName": true,
+	"replicaSet":        true,
+	"maxPoolSize":       true,
+	"connect":           true,
+}
+
+// Moves the URI options not handled by the driver (readPreference, ssl, tls, connectTimeoutMS
+// and socketTimeoutMS) to a copy of the configuration, unless already set on it.
+// Returns the copy and the URI without these options. Other options return an error.
+func (c *Config) parseURI() (*Config, string, error) {
+	u, err := url.Parse(c.URI)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid MongoDB URI: %s", err)
+	}
+
+	nc := *c
+	query := u.Query()
+	for name, values := range query {
+		value := values[len(values)-1]
+
+		switch strings.ToLower(name) {
+		case "readpreference":
+			if _, err := ParseReadPreference(value); err != nil {
+				return nil, "", err
+			}
+			if nc.ReadPreference == "" {
+				nc.ReadPreference = value
+			}
+		case "ssl", "tls":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, "", fmt.Errorf("Invalid %s option: %s", name, value)
+			}
+			nc.TLS = nc.TLS || b
+		case "connecttimeoutms", "sockettimeoutms":
+			ms, err := strconv.Atoi(value)
+			if err != nil || ms < 0 {
+				return nil, "", fmt.Errorf("Invalid %s option: %s", name, value)
+			}
+			if strings.ToLower(name) == "connecttimeoutms" && nc.ConnectTimeout == 0 {
+				nc.ConnectTimeout = time.Duration(ms) * time.Millisecond
+			} else if strings.ToLower(name) == "sockettimeoutms" && nc.SocketTimeout == 0 {
+				nc.SocketTimeout = time.Duration(ms) * time.Millisecond
+			}
+		default:
+			if !uriDriverOptions[name] {
+				return nil, "", fmt.Errorf("Unsupported MongoDB URI option: %s", name)
+			}
+			continue
+		}
+		query.Del(name)
+	}
+	u.RawQuery = query.Encode()
+	return &nc, u.String(), nil
+}
+
+// Connects to MongoDB
+func Dial(c *Config) (*mgo.Session, error) {
+	dialinfo, c, err := c.dialInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := ParseReadPreference(c.ReadPreference)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := mgo.DialWithInfo(dialinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.ReadPreference != "" {
+		session.SetMode(mode, true)
+	}
+	session.SetSyncTimeout(DefaultSyncTimeout)
+	session.SetSocketTimeout(c.SocketTimeout)
+	return session, nil
+}
+
+// Returns the dial settings, and a copy of the configuration with the URI options and
+// the default timeouts applied
+func (c *Config) dialInfo() (*mgo.DialInfo, *Config, error) {
+	var dialinfo *mgo.DialInfo
+	if c.URI != "" {
+		nc, uri, err := c.parseURI()
+		if err != nil {
+			return nil, nil, err
+		}
+		c = nc
+
+		dialinfo, err = mgo.ParseURL(uri)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid MongoDB URI: %s", err)
+		}
+	} else {
+		nc := *c
+		c = &nc
+
+		addrs := c.Seeds
+		if len(addrs) == 0 {
+			addrs = []string{net.JoinHostPort(c.Host, c.Port)}
+		}
+		dialinfo = &mgo.DialInfo{
+			Addrs:    addrs,
+			Database: c.Database,
+			Username: c.Username,
+			Password: c.Password,
+		}
+	}
+
+	if c.ReplicaSet != "" {
+		dialinfo.ReplicaSetName = c.ReplicaSet
+	}
+	if c.AuthSource != "" {
+		dialinfo.Source = c.AuthSource
+	}
+	// a zero dial timeout can block forever
+	if c.ConnectTimeout <= 0 {
+		c.ConnectTimeout = DefaultConnectTimeout
+	}
+	if c.SocketTimeout <= 0 {
+		c.SocketTimeout = DefaultSocketTimeout
+	}
+	dialinfo.Timeout = c.ConnectTimeout
+
+	if c.TLS {
+		tlsconfig, err := tlsConfig(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialinfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			return tls.Dial("tcp", addr.String(), tlsconfig)
+		}
+	}
+	return dialinfo, c, nil
+}
+
+// Returns the session mode of a read preference name. Blank is primary.
+func ParseReadPreference(name string) (mgo.Mode, error) {
+	switch strings.ToLower(name) {
+	case "", "primary":
+		return mgo.Primary, nil
+	case "primarypreferred":
+		return mgo.PrimaryPreferred, nil
+	case "secondary":
+		return mgo.Secondary, nil
+	case "secondarypreferred":
+		return mgo.SecondaryPreferred, nil
+	case "nearest":
+		return mgo.Nearest, nil
+	}
+	return mgo.Primary, fmt.Errorf("Invalid read preference: %s", name)
+}
+
+// Returns the connection address for logging, without the password
+func (c *Config) String() string {
+	if c.URI != "" {
+		u, err := url.Parse(c.URI)
+		if err != nil {
+			return "mongodb://(invalid uri)"
+		}
+		if u.User != nil {
+			u.User = url.User(u.User.Username())
+		}
+		return u.String()
+	}
+
+	hosts := strings.Join(c.Seeds, ",")
+	if hosts == "" {
+		hosts = net.JoinHostPort(c.Host, c.Port)
+	}
+	if c.Username != "" {
+		return fmt.Sprintf("mongodb://%s@%s/%s", c.Username, hosts, c.Database)
+	}
+	return fmt.Sprintf("mongodb://%s/%s", hosts, c.Database)
+}
+
+func tlsConfig(c *Config) (*tls.Config, error) {
+	tlsconfig := &tls.Config{}
+	if c.TLSCAFile != "" {
+		pool, err := LoadCertPool(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsconfig.RootCAs = pool
+	}
+	return tlsconfig, nil
+}
+
+// Loads PEM-encoded CA certificates from a file
+func LoadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA file: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in CA file %s", filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/RangelReale/appstatsd/info"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// Export files are a sequence of BSON documents, like mongodump,
+// each one with the collection name and the original document.
+type dumpRecord struct {
+	Collection string `bson:"c"`
+	Doc        bson.D `bson:"d"`
+}
+
+var dumpOpts struct {
+	collections *string
+	since       *string
+	file        *string
+}
+
+func exportFlags() {
+	dumpOpts.collections = flag.String("collections", "", "comma-separated collections to export, default log and all stat_ collections")
+	dumpOpts.since = flag.String("since", "", "only data of this date (YYYY-MM-DD) or later")
+	dumpOpts.file = flag.String("out", "", "output file, default stdout")
+}
+
+func importFlags() {
+	dumpOpts.file = flag.String("in", "", "input file, default stdin")
+}
+
+func cmdExport(args []string) error {
+	session, err := DBConnectClone()
+	if err != nil {
+		return fmt.Errorf("Error connecting to database: %s", err)
+	}
+	defer session.Close()
+	db := session.DB(Configuration.MGODBName)
+
+	collections := info.SplitParams(*dumpOpts.collections)
+	if len(collections) == 0 {
+		names, err := db.CollectionNames()
+		if err != nil {
+			return fmt.Errorf("Error listing collections: %s", err)
+		}
+		for _, name := range names {
+			if name == "log" || strings.HasPrefix(name, "stat_") {
+				collections = append(collections, name)
+			}
+		}
+	}
+
+	var since time.Time
+	if *dumpOpts.since != "" {
+		if since, err = time.Parse("2006-01-02", *dumpOpts.since); err != nil {
+			return fmt.Errorf("Invalid since date: %s", err)
+		}
+	}
+
+	out := os.Stdout
+	if *dumpOpts.file != "" {
+		if out, err = os.Create(*dumpOpts.file); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+
+	total := 0
+	for _, name := range collections {
+		filter := bson.M{}
+		if !since.IsZero() {
+			if name == "log" {
+				filter["dt"] = bson.M{"$gte": since}
+			} else {
+				filter["_dt"] = bson.M{"$gte": since.Format("2006-01-02")}
+			}
+		}
+
+		iter := db.C(name).Find(filter).Sort("_id").Iter()
+		var doc bson.D
+		for iter.Next(&doc) {
+			b, err := bson.Marshal(&dumpRecord{Collection: name, Doc: doc})
+			if err != nil {
+				iter.Close()
+				return fmt.Errorf("Error encoding document of %s: %s", name, err)
+			}
+			if _, err := w.Write(b); err != nil {
+				iter.Close()
+				return err
+			}
+			total++
+			doc = nil
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("Error reading %s: %s", name, err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Notice("Exported %d documents from %d collections", total, len(collections))
+	return nil
+}
+
+// Imports an export file. Log messages are saved by id, and statistics by day and parameters, like
+// when received, so importing the same file again does not duplicate data.
+func cmdImport(args []string) error {
+	session, err := DBConnectClone()
+	if err != nil {
+		return fmt.Errorf("Error connecting to database: %s", err)
+	}
+	defer session.Close()
+	db := session.DB(Configuration.MGODBName)
+
+	in := os.Stdin
+	if *dumpOpts.file != "" {
+		if in, err = os.Open(*dumpOpts.file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	r := bufio.NewReader(in)
+
+	total := 0
+	for {
+		b, err := dumpReadDocument(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Error reading document %d: %s", total+1, err)
+		}
+
+		var rec dumpRecord
+		if err := bson.Unmarshal(b, &rec); err != nil {
+			return fmt.Errorf("Error decoding document %d: %s", total+1, err)
+		}
+		if rec.Collection != "log" && !strings.HasPrefix(rec.Collection, "stat_") {
+			return fmt.Errorf("Invalid collection on document %d: %s", total+1, rec.Collection)
+		}
+
+		selector, doc, err := dumpImportKey(rec.Collection, rec.Doc)
+		if err != nil {
+			return fmt.Errorf("Document %d of %s: %s", total+1, rec.Collection, err)
+		}
+		if _, err := db.C(rec.Collection).Upsert(selector, doc); err != nil {
+			return fmt.Errorf("Error saving document %d: %s", total+1, err)
+		}
+		total++
+	}
+
+	log.Notice("Imported %d documents", total)
+	return nil
+}
+
+// Returns the selector and the document to upsert. Log messages are selected by id.
+// Statistics are selected by day, app and parameters, the same keys used when they are received,
+// and saved without the exported id, as the existing document of the day can have another one.
+func dumpImportKey(collection string, d bson.D) (bson.M, bson.D, error) {
+	selector := bson.M{}
+	if collection == "log" {
+		for _, e := range d {
+			if e.Name == "_id" {
+				selector["_id"] = e.Value
+			}
+		}
+		if len(selector) == 0 {
+			return nil, nil, fmt.Errorf("no id")
+		}
+		return selector, d, nil
+	}
+
+	doc := make(bson.D, 0, len(d))
+	for _, e := range d {
+		switch e.Name {
+		case "_id":
+			continue
+		case "_dy", "_hr":
+			// values
+		default:
+			// _dt, _app and parameters
+			selector[e.Name] = e.Value
+		}
+		doc = append(doc, e)
+	}
+	if _, ok := selector["_dt"]; !ok {
+		return nil, nil, fmt.Errorf("no date")
+	}
+	return selector, doc, nil
+}
+
+// Reads a length-prefixed BSON document
+func dumpReadDocument(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(size[:])
+	if length < 5 || length > 16*1024*1024 {
+		return nil, fmt.Errorf("invalid document size %d", length)
+	}
+
+	b := make([]byte, length)
+	copy(b, size[:])
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
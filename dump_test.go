@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/mgo.v2/bson"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestDumpReadDocument(t *testing.T) {
+	doc1 := []byte{5, 0, 0, 0, 0}
+	doc2 := []byte{8, 0, 0, 0, 1, 2, 3, 0}
+
+	r := bytes.NewReader(append(append([]byte{}, doc1...), doc2...))
+	for _, expected := range [][]byte{doc1, doc2} {
+		b, err := dumpReadDocument(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, expected) {
+			t.Errorf("expected %v, got %v", expected, b)
+		}
+	}
+	if _, err := dumpReadDocument(r); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	if _, err := dumpReadDocument(bytes.NewReader(doc2[:6])); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated document should return ErrUnexpectedEOF, got %v", err)
+	}
+	if _, err := dumpReadDocument(bytes.NewReader([]byte{2, 0, 0, 0})); err == nil {
+		t.Error("invalid size should return an error")
+	}
+}
+
+func TestDumpImportKey(t *testing.T) {
+	id := bson.NewObjectId()
+
+	doc := bson.D{{Name: "_id", Value: id}, {Name: "_dt", Value: "2014-01-02"}, {Name: "_app", Value: "app1"}, {Name: "proj", Value: "p1"}, {Name: "_dy", Value: bson.M{"c_ct": 2}}}
+	selector, saved, err := dumpImportKey("stat_conn_proj-app", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(selector, bson.M{"_dt": "2014-01-02", "_app": "app1", "proj": "p1"}) {
+		t.Errorf("unexpected selector: %v", selector)
+	}
+	for _, e := range saved {
+		if e.Name == "_id" {
+			t.Error("statistics should be saved without the exported id")
+		}
+	}
+	if len(saved) != 4 {
+		t.Errorf("unexpected document: %v", saved)
+	}
+
+	selector, _, err = dumpImportKey("log", bson.D{{Name: "_id", Value: id}, {Name: "app", Value: "app1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(selector, bson.M{"_id": id}) {
+		t.Errorf("log messages should be selected by id, got %v", selector)
+	}
+
+	if _, _, err := dumpImportKey("stat_conn", bson.D{{Name: "_id", Value: id}}); err == nil {
+		t.Error("statistics without date should return an error")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Name pattern, either a glob or a regular expression between slashes, like /^app[0-9]+$/
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func newNamePattern(pattern string) (*namePattern, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid regular expression %s: %s", pattern, err)
+		}
+		return &namePattern{re: re}, nil
+	}
+
+	// check glob syntax
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("Invalid pattern %s: %s", pattern, err)
+	}
+	return &namePattern{glob: pattern}, nil
+}
+
+func (p *namePattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	m, _ := path.Match(p.glob, name)
+	return m
+}
+
+// Allow and deny list of names. If the allow list is not empty, names must
+// match one of its patterns, and must not match any of the deny list.
+type NameFilter struct {
+	allow []*namePattern
+	deny  []*namePattern
+}
+
+func NewNameFilter(allow []string, deny []string) (*NameFilter, error) {
+	f := &NameFilter{}
+	for _, a := range allow {
+		p, err := newNamePattern(a)
+		if err != nil {
+			return nil, err
+		}
+		f.allow = append(f.allow, p)
+	}
+	for _, d := range deny {
+		p, err := newNamePattern(d)
+		if err != nil {
+			return nil, err
+		}
+		f.deny = append(f.deny, p)
+	}
+	return f, nil
+}
+
+func (f *NameFilter) Allow(name string) bool {
+	if len(f.allow) > 0 {
+		found := false
+		for _, p := range f.allow {
+			if p.Match(name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, p := range f.deny {
+		if p.Match(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Filters of received metrics and logs
+type IngestFilter struct {
+	Apps   *NameFilter
+	Infos  *NameFilter // info path without parameters, like conn.proj
+	Fields *NameFilter
+}
+
+var ingestFilter = &IngestFilter{
+	Apps:   &NameFilter{},
+	Infos:  &NameFilter{},
+	Fields: &NameFilter{},
+}
+
+// Builds the ingest filter from the configuration
+func NewIngestFilter(c *Config) (*IngestFilter, error) {
+	var err error
+	f := &IngestFilter{}
+	if f.Apps, err = NewNameFilter(c.AllowApps, c.DenyApps); err != nil {
+		return nil, err
+	}
+	if f.Infos, err = NewNameFilter(c.AllowInfos, c.DenyInfos); err != nil {
+		return nil, err
+	}
+	if f.Fields, err = NewNameFilter(c.AllowFields, c.DenyFields); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Checks a metric bucket in the appname.info1#param1.info2.field format.
+// Rejected metrics are counted on the _system.rejected.metrics internal counter.
+func (f *IngestFilter) AllowMetric(bucket string) bool {
+	values := strings.Split(bucket, ".")
+	app := values[0]
+
+	allowed := f.Apps.Allow(app)
+	if allowed && len(values) > 1 {
+		infos := make([]string, 0, len(values)-2)
+		for _, iv := range values[1 : len(values)-1] {
+			infos = append(infos, strings.SplitN(iv, "#", 2)[0])
+		}
+		allowed = f.Infos.Allow(strings.Join(infos, ".")) && f.Fields.Allow(values[len(values)-1])
+	}
+
+	if !allowed {
+		SystemCount("_system.rejected.metrics", 1)
+	}
+	return allowed
+}
+
+// Checks a log app.
+// Rejected logs are counted on the _system.rejected.logs internal counter.
+func (f *IngestFilter) AllowLog(app string) bool {
+	if !f.Apps.Allow(app) {
+		SystemCount("_system.rejected.logs", 1)
+		return false
+	}
+	return true
+}
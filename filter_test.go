@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNameFilter(t *testing.T) {
+	f, err := NewNameFilter([]string{"app*", "/^svc[0-9]+$/"}, []string{"apptest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"app1":    true,
+		"apptest": false,
+		"svc12":   true,
+		"svc12a":  false,
+		"other":   false,
+	}
+	for name, allowed := range tests {
+		if f.Allow(name) != allowed {
+			t.Errorf("name %s should be allowed=%t", name, allowed)
+		}
+	}
+
+	if _, err := NewNameFilter([]string{"/[/"}, nil); err == nil {
+		t.Error("invalid regular expression should return an error")
+	}
+}
+
+func TestIngestFilterMetric(t *testing.T) {
+	c := NewConfig()
+	c.DenyInfos = []string{"conn.*"}
+	c.AllowFields = []string{"ct", "dr"}
+
+	f, err := NewIngestFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"app1.conn.ct":           true,
+		"app1.conn#proj.proc.ct": false,
+		"app1.req#get.dr":        true,
+		"app1.req.size":          false,
+	}
+	for bucket, allowed := range tests {
+		if f.AllowMetric(bucket) != allowed {
+			t.Errorf("bucket %s should be allowed=%t", bucket, allowed)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/RangelReale/gostatsd/statsd"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maximum metrics per pickle message
+const graphitePickleBatch = 500
+
+// timeout to connect and send the metrics of each flush
+const graphiteTimeout = 5 * time.Second
+
+// maximum distinct paths aggregated between flushes, new paths over it are dropped
+const graphiteMaxPaths = 10000
+
+// flushes without updates after which a gauge is not sent anymore
+const graphiteGaugeExpire = 6
+
+// Forwarder of received metrics to Graphite, nil if disabled
+var graphite *GraphiteForwarder
+
+// closed when the periodic flush stops on shutdown
+var graphiteStopped = make(chan struct{})
+
+// last gauge value, and the flushes since it was received
+type graphiteGauge struct {
+	Value float64
+	Idle  int
+}
+
+// aggregated timer values
+type graphiteTimer struct {
+	Count int64
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+// Aggregates received metrics and sends them periodically to a Carbon server.
+// Counters are summed, gauges keep the last value, and timers are sent as
+// PATH.count, PATH.sum, PATH.mean, PATH.min and PATH.max.
+// All values are sent with the flush time.
+type GraphiteForwarder struct {
+	Addr     string
+	Protocol string // plaintext or pickle
+	Template string // with {app}, {info}, {field} and {type}
+	Interval time.Duration
+
+	mu          sync.Mutex
+	counters    map[string]float64
+	gauges      map[string]*graphiteGauge
+	timers      map[string]*graphiteTimer
+	cardinality *dbCardinalityCache
+}
+
+// Creates the forwarder of the configuration, nil if disabled
+func NewGraphiteForwarder(c *Config) *GraphiteForwarder {
+	if c.GraphiteAddr == "" {
+		return nil
+	}
+	return &GraphiteForwarder{
+		Addr:        c.GraphiteAddr,
+		Protocol:    c.GraphiteProtocol,
+		Template:    c.GraphiteTemplate,
+		Interval:    time.Duration(c.GraphiteFlushInterval) * time.Second,
+		counters:    make(map[string]float64),
+		gauges:      make(map[string]*graphiteGauge),
+		timers:      make(map[string]*graphiteTimer),
+		cardinality: newDBCardinalityCache(),
+	}
+}
+
+// Adds a metric received with the timestamp tm. Buckets that cannot be converted to a path are ignored.
+// As values are sent with the flush time, metrics with a timestamp more than one flush interval
+// from now are dropped, and counted in _appstatsd.graphite.dropped. Parameter values over the
+// cardinality limits are replaced by "__other__", and new paths over graphiteMaxPaths are dropped.
+func (g *GraphiteForwarder) Add(m *statsd.Metric, tm time.Time) {
+	if skew := time.Since(tm); skew > g.Interval || skew < -g.Interval {
+		SystemCount(systemGraphiteDropped, 1)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	folded := *m
+	folded.Bucket = g.foldParams(m.Bucket, tm)
+	path, ok := g.Path(&folded)
+	if !ok {
+		return
+	}
+
+	if !g.hasPath(path, m.Type) && len(g.counters)+len(g.gauges)+len(g.timers) >= graphiteMaxPaths {
+		SystemCount(systemGraphiteDropped, 1)
+		return
+	}
+
+	switch m.Type {
+	case statsd.COUNTER:
+		g.counters[path] += m.Value
+	case statsd.GAUGE:
+		g.gauges[path] = &graphiteGauge{Value: m.Value}
+	case statsd.TIMER:
+		t, ok := g.timers[path]
+		if !ok {
+			t = &graphiteTimer{Min: m.Value, Max: m.Value}
+			g.timers[path] = t
+		}
+		t.Count++
+		t.Sum += m.Value
+		t.Min = math.Min(t.Min, m.Value)
+		t.Max = math.Max(t.Max, m.Value)
+	}
+}
+
+// Checks if the path of the metric type is already aggregated
+func (g *GraphiteForwarder) hasPath(path string, typ statsd.MetricType) bool {
+	switch typ {
+	case statsd.COUNTER:
+		_, ok := g.counters[path]
+		return ok
+	case statsd.GAUGE:
+		_, ok := g.gauges[path]
+		return ok
+	case statsd.TIMER:
+		_, ok := g.timers[path]
+		return ok
+	}
+	return false
+}
+
+// Replaces the parameter values of the bucket over the cardinality limits by "__other__",
+// using the same collection and parameter names as the database
+func (g *GraphiteForwarder) foldParams(bucket string, tm time.Time) string {
+	values := strings.Split(bucket, ".")
+	if len(values) < 3 {
+		return bucket
+	}
+
+	day := tm.Format("2006-01-02")
+	oldest := time.Now().Add(-24 * time.Hour).Format("2006-01-02")
+	collection := "stat"
+	for i, iv := range values[1 : len(values)-1] {
+		info := strings.Split(iv, "#")
+		collection = collection + "_" + info[0]
+		for ridx, rv := range info[1:] {
+			if rv == "" {
+				continue
+			}
+			pname := info[0]
+			if ridx > 0 {
+				pname = fmt.Sprintf("%s%d", info[0], ridx)
+			}
+			if limit := dbCardinalityLimit(collection, pname); limit > 0 {
+				info[ridx+1], _ = g.cardinality.Check(collection, pname, rv, day, limit, oldest, nil)
+			}
+		}
+		values[i+1] = strings.Join(info, "#")
+	}
+	return strings.Join(values, ".")
+}
+
+// Converts a app.info1#param1#param2.info2#param1.field bucket to a Graphite path using the template.
+// {info} is replaced by the infos and their parameters, like info1.param1.param2.info2.param1.
+func (g *GraphiteForwarder) Path(m *statsd.Metric) (string, bool) {
+	values := strings.Split(m.Bucket, ".")
+	if len(values) < 3 || strings.HasPrefix(m.Bucket, "_") {
+		return "", false
+	}
+
+	var info []string
+	for _, iv := range values[1 : len(values)-1] {
+		for _, item := range strings.Split(iv, "#") {
+			if item != "" {
+				info = append(info, graphiteNode(item))
+			}
+		}
+	}
+	if len(info) == 0 {
+		return "", false
+	}
+
+	var typ string
+	switch m.Type {
+	case statsd.COUNTER:
+		typ = "counters"
+	case statsd.GAUGE:
+		typ = "gauges"
+	case statsd.TIMER:
+		typ = "timers"
+	default:
+		return "", false
+	}
+
+	return strings.NewReplacer(
+		"{app}", graphiteNode(values[0]),
+		"{info}", strings.Join(info, "."),
+		"{field}", graphiteNode(values[len(values)-1]),
+		"{type}", typ,
+	).Replace(g.Template), true
+}
+
+// Replaces characters not allowed in a path node
+func graphiteNode(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '.' || r == '/' || r == '\\' || r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+type graphiteValue struct {
+	Path  string
+	Value float64
+}
+
+// Returns the aggregated values since the last call, and resets them
+func (g *GraphiteForwarder) take() []graphiteValue {
+	g.mu.Lock()
+	counters := g.counters
+	g.counters = make(map[string]float64)
+	timers := g.timers
+	g.timers = make(map[string]*graphiteTimer)
+	// gauges keep their value until changed, or until not updated for graphiteGaugeExpire flushes
+	gauges := make(map[string]float64, len(g.gauges))
+	for path, gauge := range g.gauges {
+		if gauge.Idle >= graphiteGaugeExpire {
+			delete(g.gauges, path)
+			continue
+		}
+		gauges[path] = gauge.Value
+		gauge.Idle++
+	}
+	g.mu.Unlock()
+
+	var ret []graphiteValue
+	for path, value := range counters {
+		ret = append(ret, graphiteValue{path, value})
+	}
+	for path, value := range gauges {
+		ret = append(ret, graphiteValue{path, value})
+	}
+	for path, t := range timers {
+		ret = append(ret,
+			graphiteValue{path + ".count", float64(t.Count)},
+			graphiteValue{path + ".sum", t.Sum},
+			graphiteValue{path + ".mean", t.Sum / float64(t.Count)},
+			graphiteValue{path + ".min", t.Min},
+			graphiteValue{path + ".max", t.Max},
+		)
+	}
+	return ret
+}
+
+// Sends the aggregated values to the Carbon server. Values are dropped if they cannot be sent.
+func (g *GraphiteForwarder) Flush() {
+	values := g.take()
+	if len(values) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	if g.Protocol == "pickle" {
+		graphiteWritePickle(&buf, values, time.Now())
+	} else {
+		graphiteWritePlaintext(&buf, values, time.Now())
+	}
+
+	conn, err := net.DialTimeout("tcp", g.Addr, graphiteTimeout)
+	if err != nil {
+		log.Error("Error connecting to graphite, %d values dropped: %s", len(values), err)
+		SystemCount(systemGraphiteErrors, 1)
+		return
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		log.Error("Error sending to graphite, %d values dropped: %s", len(values), err)
+		SystemCount(systemGraphiteErrors, 1)
+	}
+}
+
+// PATH VALUE TIMESTAMP
+func graphiteWritePlaintext(buf *bytes.Buffer, values []graphiteValue, tm time.Time) {
+	for _, v := range values {
+		fmt.Fprintf(buf, "%s %v %d\n", v.Path, v.Value, tm.Unix())
+	}
+}
+
+// Pickle protocol: each message is a 4-byte big endian length followed by a pickled
+// list of (PATH, (TIMESTAMP, VALUE)) tuples
+func graphiteWritePickle(buf *bytes.Buffer, values []graphiteValue, tm time.Time) {
+	for len(values) > 0 {
+		n := len(values)
+		if n > graphitePickleBatch {
+			n = graphitePickleBatch
+		}
+
+		var p bytes.Buffer
+		p.WriteString("\x80\x02") // PROTO 2
+		p.WriteString("](")       // EMPTY_LIST, MARK
+		for _, v := range values[:n] {
+			// BINUNICODE
+			p.WriteByte('X')
+			binary.Write(&p, binary.LittleEndian, uint32(len(v.Path)))
+			p.WriteString(v.Path)
+			// BINFLOAT
+			p.WriteByte('G')
+			binary.Write(&p, binary.BigEndian, float64(tm.Unix()))
+			p.WriteByte('G')
+			binary.Write(&p, binary.BigEndian, v.Value)
+			p.WriteString("\x86\x86") // TUPLE2, TUPLE2
+		}
+		p.WriteString("e.") // APPENDS, STOP
+
+		binary.Write(buf, binary.BigEndian, uint32(p.Len()))
+		buf.Write(p.Bytes())
+
+		values = values[n:]
+	}
+}
+
+// Sends the aggregated metrics to Graphite periodically, until shutdown
+func ServerGraphite() {
+	defer close(graphiteStopped)
+
+	if graphite == nil {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(Configuration.GraphiteFlushInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			graphite.Flush()
+		case <-shutdownChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/RangelReale/gostatsd/statsd"
+	"testing"
+	"time"
+)
+
+func TestGraphitePath(t *testing.T) {
+	g := &GraphiteForwarder{Template: "appstatsd.{type}.{app}.{info}.{field}"}
+
+	tests := []struct {
+		metric statsd.Metric
+		path   string
+		ok     bool
+	}{
+		{statsd.Metric{Type: statsd.COUNTER, Bucket: "app1.conn#proj1.ct"}, "appstatsd.counters.app1.conn.proj1.ct", true},
+		{statsd.Metric{Type: statsd.TIMER, Bucket: "app1.conn#proj 1#x.proc#p1.dr"}, "appstatsd.timers.app1.conn.proj_1.x.proc.p1.dr", true},
+		{statsd.Metric{Type: statsd.GAUGE, Bucket: "app1.conn##p2.mem"}, "appstatsd.gauges.app1.conn.p2.mem", true},
+		{statsd.Metric{Type: statsd.COUNTER, Bucket: "app1.ct"}, "", false},
+		{statsd.Metric{Type: statsd.COUNTER, Bucket: "_app1.conn.ct"}, "", false},
+	}
+
+	for _, tt := range tests {
+		path, ok := g.Path(&tt.metric)
+		if ok != tt.ok || path != tt.path {
+			t.Errorf("%s: expected %q %v, got %q %v", tt.metric.Bucket, tt.path, tt.ok, path, ok)
+		}
+	}
+}
+
+func TestGraphiteTake(t *testing.T) {
+	g := NewGraphiteForwarder(&Config{GraphiteAddr: "localhost:2003", GraphiteTemplate: "{app}.{info}.{field}", GraphiteFlushInterval: 10})
+	now := time.Now()
+
+	g.Add(&statsd.Metric{Type: statsd.COUNTER, Bucket: "app1.conn.ct", Value: 2}, now)
+	g.Add(&statsd.Metric{Type: statsd.COUNTER, Bucket: "app1.conn.ct", Value: 3}, now)
+	g.Add(&statsd.Metric{Type: statsd.TIMER, Bucket: "app1.conn.dr", Value: 10}, now)
+	g.Add(&statsd.Metric{Type: statsd.TIMER, Bucket: "app1.conn.dr", Value: 30}, now)
+	g.Add(&statsd.Metric{Type: statsd.GAUGE, Bucket: "app1.conn.mem", Value: 7}, now)
+
+	values := make(map[string]float64)
+	for _, v := range g.take() {
+		values[v.Path] = v.Value
+	}
+	expected := map[string]float64{
+		"app1.conn.ct":       5,
+		"app1.conn.dr.count": 2,
+		"app1.conn.dr.sum":   40,
+		"app1.conn.dr.mean":  20,
+		"app1.conn.dr.min":   10,
+		"app1.conn.dr.max":   30,
+		"app1.conn.mem":      7,
+	}
+	for path, value := range expected {
+		if values[path] != value {
+			t.Errorf("%s: expected %f, got %f", path, value, values[path])
+		}
+	}
+
+	// counters and timers are reset, gauges are kept
+	values = make(map[string]float64)
+	for _, v := range g.take() {
+		values[v.Path] = v.Value
+	}
+	if len(values) != 1 || values["app1.conn.mem"] != 7 {
+		t.Errorf("only the gauge should be kept, got %v", values)
+	}
+
+	// gauges not updated expire
+	for i := 0; i < graphiteGaugeExpire; i++ {
+		g.take()
+	}
+	if values := g.take(); len(values) != 0 {
+		t.Errorf("gauge should have expired, got %v", values)
+	}
+}
+
+func TestGraphiteAddLimits(t *testing.T) {
+	defer func(limit int32) {
+		Configuration.ParamCardinalityLimit = limit
+	}(Configuration.ParamCardinalityLimit)
+	Configuration.ParamCardinalityLimit = 2
+
+	g := NewGraphiteForwarder(&Config{GraphiteAddr: "localhost:2003", GraphiteTemplate: "{app}.{info}.{field}", GraphiteFlushInterval: 10})
+	now := time.Now()
+
+	for _, proj := range []string{"p1", "p2", "p3", "p4"} {
+		g.Add(&statsd.Metric{Type: statsd.COUNTER, Bucket: "app1.conn#" + proj + ".ct", Value: 1}, now)
+	}
+	// timestamps outside the flush interval are dropped
+	g.Add(&statsd.Metric{Type: statsd.COUNTER, Bucket: "app1.conn#p1.ct", Value: 1}, now.Add(-time.Minute))
+
+	values := make(map[string]float64)
+	for _, v := range g.take() {
+		values[v.Path] = v.Value
+	}
+	expected := map[string]float64{
+		"app1.conn.p1.ct":        1,
+		"app1.conn.p2.ct":        1,
+		"app1.conn.__other__.ct": 2,
+	}
+	if len(values) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+	for path, value := range expected {
+		if values[path] != value {
+			t.Errorf("%s: expected %f, got %f", path, value, values[path])
+		}
+	}
+
+	// new paths over the limit are dropped
+	Configuration.ParamCardinalityLimit = 0
+	for i := 0; i < graphiteMaxPaths+10; i++ {
+		g.Add(&statsd.Metric{Type: statsd.COUNTER, Bucket: fmt.Sprintf("app1.conn#p%d.ct", i), Value: 1}, now)
+	}
+	if n := len(g.take()); n != graphiteMaxPaths {
+		t.Errorf("expected %d paths, got %d", graphiteMaxPaths, n)
+	}
+}
+
+func TestGraphiteWrite(t *testing.T) {
+	tm := time.Unix(1400000000, 0)
+	values := []graphiteValue{{"app1.conn.ct", 5}}
+
+	var buf bytes.Buffer
+	graphiteWritePlaintext(&buf, values, tm)
+	if buf.String() != "app1.conn.ct 5 1400000000\n" {
+		t.Errorf("unexpected plaintext: %q", buf.String())
+	}
+
+	buf.Reset()
+	graphiteWritePickle(&buf, values, tm)
+	if buf.Len() < 4 || int(binary.BigEndian.Uint32(buf.Bytes()[:4])) != buf.Len()-4 {
+		t.Fatalf("invalid pickle length header: %q", buf.Bytes())
+	}
+	if !bytes.HasPrefix(buf.Bytes()[4:], []byte("\x80\x02](X\x0c\x00\x00\x00app1.conn.ct")) || !bytes.HasSuffix(buf.Bytes(), []byte("\x86\x86e.")) {
+		t.Errorf("unexpected pickle: %q", buf.Bytes())
+	}
+}
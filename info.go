@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/plotinum/vg"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/RangelReale/appstatsd/dbconn"
+	"github.com/RangelReale/appstatsd/infohttp"
+	"github.com/gorilla/mux"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Creates the info server. Requests in progress, including log streams, are
+// cancelled when it is shut down.
+func NewInfoServer() *http.Server {
+	r := mux.NewRouter()
+
+	r.HandleFunc("/log", func(w http.ResponseWriter, r *http.Request) {
+		apps, ok := authRequest(w, r)
+		if !ok {
+			return
+		}
+
+		session, err := DBConnectClone()
+		if err != nil {
+			handleError(fmt.Errorf("Error reading data: %s", err), w, r)
+			return
+		}
+		defer session.Close()
+
+		db := session.DB(Configuration.MGODBName)
+
+		if err := infohttp.HandleLog(db, apps, w, r); err != nil {
+			handleError(err, w, r)
+		}
+	})
+
+	r.HandleFunc("/log/stream", func(w http.ResponseWriter, r *http.Request) {
+		apps, ok := authRequest(w, r)
+		if !ok {
+			return
+		}
+
+		session, err := DBConnectClone()
+		if err != nil {
+			handleError(fmt.Errorf("Error reading data: %s", err), w, r)
+			return
+		}
+		defer session.Close()
+
+		db := session.DB(Configuration.MGODBName)
+
+		if err := infohttp.HandleLogStream(db, apps, w, r); err != nil {
+			handleError(err, w, r)
+		}
+	})
+
+	r.HandleFunc("/log/summary", func(w http.ResponseWriter, r *http.Request) {
+		apps, ok := authRequest(w, r)
+		if !ok {
+			return
+		}
+
+		session, err := DBConnectClone()
+		if err != nil {
+			handleError(fmt.Errorf("Error reading data: %s", err), w, r)
+			return
+		}
+		defer session.Close()
+
+		db := session.DB(Configuration.MGODBName)
+
+		if err := infohttp.HandleLogSummary(db, apps, w, r); err != nil {
+			handleError(err, w, r)
+		}
+	})
+
+	r.HandleFunc("/stats/{process}", func(w http.ResponseWriter, r *http.Request) {
+		apps, ok := authRequest(w, r)
+		if !ok {
+			return
+		}
+
+		session, err := DBConnectClone()
+		if err != nil {
+			handleError(fmt.Errorf("Error reading data: %s", err), w, r)
+			return
+		}
+		defer session.Close()
+
+		db := session.DB(Configuration.MGODBName)
+
+		vars := mux.Vars(r)
+		process := vars["process"]
+
+		if err := infohttp.HandleStats(process, db, apps, w, r); err != nil {
+			handleError(err, w, r)
+		}
+	})
+
+	r.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		apps, ok := authRequest(w, r)
+		if !ok {
+			return
+		}
+
+		session, err := DBConnectClone()
+		if err != nil {
+			handleError(fmt.Errorf("Error reading data: %s", err), w, r)
+			return
+		}
+		defer session.Close()
+
+		db := session.DB(Configuration.MGODBName)
+
+		configMu.RLock()
+		rules := Configuration.PrometheusRules
+		configMu.RUnlock()
+
+		if err := infohttp.HandleMetrics(db, rules, apps, w, r); err != nil {
+			handleError(err, w, r)
+		}
+	})
+
+	r.HandleFunc("/debug/metrics", func(w http.ResponseWriter, r *http.Request) {
+		apps, ok := authRequest(w, r)
+		if !ok {
+			return
+		}
+		// internal metrics are not restricted to an app
+		if apps != nil {
+			handleUnauthorized(w, r)
+			return
+		}
+
+		stenc, err := json.Marshal(infohttp.InfoResponse{Data: SystemSnapshot()})
+		if err != nil {
+			handleError(fmt.Errorf("Error encoding data: %s", err), w, r)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json; charset=utf-8")
+		w.Write(stenc)
+	})
+	r.NotFoundHandler = http.HandlerFunc(handleNotFound)
+
+	basectx, cancel := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        fmt.Sprintf("%s:%d", Configuration.InfoListenHost, Configuration.InfoPort),
+		Handler:     r,
+		BaseContext: func(net.Listener) context.Context { return basectx },
+	}
+	server.RegisterOnShutdown(cancel)
+	return server
+}
+
+// Serves the info server until it is shut down
+func ServerInfo(server *http.Server) {
+	var err error
+	if Configuration.InfoTLSCertFile != "" && Configuration.InfoTLSKeyFile != "" {
+		if Configuration.InfoTLSClientCAFile != "" {
+			pool, err := dbconn.LoadCertPool(Configuration.InfoTLSClientCAFile)
+			if err != nil {
+				log.Fatal("Error loading info client CA: %s", err)
+			}
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+			}
+		}
+		err = server.ListenAndServeTLS(Configuration.InfoTLSCertFile, Configuration.InfoTLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal("Error on info server: %s", err)
+	}
+}
+
+// Stops accepting requests and waits for the ones in progress
+func ShutdownInfo(server *http.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
+
+// Loads the chart fonts from the embedded resources
+// ONLY IN CUSTOM REPOSITORY: https://code.google.com/r/rangelspam-plotium
+func infoLoadFonts() {
+	for _, fontasset := range AssetNames() {
+		if strings.HasPrefix(fontasset, "res/fonts/") {
+			fontname := strings.TrimSuffix(path.Base(fontasset), path.Ext(fontasset))
+			fontbytes, err := Asset(fontasset)
+			if err != nil {
+				panic(err)
+			}
+			fontreader := bytes.NewReader(fontbytes)
+			vg.LoadFont(fontname, fontreader)
+		}
+	}
+}
+
+func handleError(err error, w http.ResponseWriter, r *http.Request) {
+	log.Error("Info error: %s", err)
+
+	stenc, eerr := json.Marshal(infohttp.InfoResponse{ErrorCode: 1, ErrorMessage: err.Error()})
+	if eerr != nil {
+		w.Write([]byte(fmt.Sprintf("Error: %s", err)))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Write(stenc)
+}
+
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	log.Error("URL not found: %s", r.URL)
+
+	stenc, eerr := json.Marshal(infohttp.InfoResponse{ErrorCode: 404, ErrorMessage: "Not found"})
+	if eerr != nil {
+		w.Write([]byte("Error: Not found"))
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Write(stenc)
+}
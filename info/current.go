@@ -0,0 +1,184 @@
+package info
+
+import (
+	"fmt"
+	"github.com/RangelReale/appstatsd/data"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Query of the values of the current period (the current day, hour or 15 minutes)
+type CurrentQuery struct {
+	Process string
+	Data    []string
+	Period  string   // day, hour, minute
+	Groups  []string // parameters to group by, "_app" for the app. Other parameters are summed
+	App     bool     // use the per-app statistics
+	Apps    []string // if not nil, only these apps can be returned
+}
+
+type CurrentResult struct {
+	Groups map[string]interface{}
+	// counters are the sum on the period, timers and gauges the average
+	Values map[string]float64
+}
+
+// Returns the values of the current period grouped by q.Groups, or an empty list if the process has no data
+func QueryCurrent(db *mgo.Database, q *CurrentQuery) ([]*CurrentResult, error) {
+	// check parameters
+	if q.Process == "" || len(q.Data) == 0 {
+		return nil, fmt.Errorf("Required parameter not sent")
+	}
+
+	// sanitize
+	if !data.ValidateValueName(q.Process) {
+		return nil, fmt.Errorf("Invalid process name - name not validated: %s", q.Process)
+	}
+	for _, gval := range q.Groups {
+		if gval != "_app" && !data.ValidateName(gval) {
+			return nil, fmt.Errorf("Invalid group name - name not validated: %s", gval)
+		}
+	}
+	switch q.Period {
+	case "day", "hour", "minute":
+	default:
+		return nil, fmt.Errorf("Invalid period: %s", q.Period)
+	}
+
+	// global statistics contain data of all apps, restricted queries must use the per-app ones
+	if q.Apps != nil && !q.App {
+		return nil, fmt.Errorf("Access denied to global statistics")
+	}
+
+	cname := fmt.Sprintf("stat_%s", q.Process)
+	if q.App {
+		cname += "-app"
+	}
+
+	// no data was received yet
+	if !infoCollectionExists(db, cname) {
+		return []*CurrentResult{}, nil
+	}
+
+	now := time.Now().UTC()
+
+	filter := bson.M{"_dt": now.Format("2006-01-02")}
+	if q.Apps != nil {
+		filter["_app"] = bson.M{"$in": q.Apps}
+	}
+
+	results := make(map[string]*CurrentResult)
+	var resultorder []string
+
+	// sums and sample counts
+	sums := make(map[string]map[string]float64)
+
+	iter := db.C(cname).Find(filter).Iter()
+	fdata := make(map[string]interface{})
+	for iter.Next(&fdata) {
+		values := currentPeriodValues(fdata, q.Period, now)
+
+		// build group string
+		groups := make(map[string]interface{}, len(q.Groups))
+		curgroup := ""
+		for _, g := range q.Groups {
+			gv, ok := fdata[g]
+			if !ok {
+				// document without this parameter
+				gv = ""
+			}
+			groups[g] = gv
+			curgroup = curgroup + "::" + fmt.Sprintf("%v", gv)
+		}
+
+		gsums, ok := sums[curgroup]
+		if !ok {
+			gsums = make(map[string]float64)
+			sums[curgroup] = gsums
+			results[curgroup] = &CurrentResult{Groups: groups}
+			resultorder = append(resultorder, curgroup)
+		}
+
+		for _, d := range q.Data {
+			gsums[d] += currentValue(values, d)
+			if n := currentCountField(d); n != "" {
+				gsums[n] += currentValue(values, n)
+			}
+		}
+
+		fdata = make(map[string]interface{})
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, fmt.Errorf("Error reading data: %s", err)
+	}
+
+	sort.Strings(resultorder)
+	ret := make([]*CurrentResult, 0, len(resultorder))
+	for _, g := range resultorder {
+		res := results[g]
+		res.Values = make(map[string]float64, len(q.Data))
+		for _, d := range q.Data {
+			v := sums[g][d]
+			if n := currentCountField(d); n != "" {
+				if sums[g][n] > 0 {
+					v = v / sums[g][n]
+				} else {
+					v = 0
+				}
+			}
+			res.Values[d] = v
+		}
+		ret = append(ret, res)
+	}
+	return ret, nil
+}
+
+// Returns the values of the period of tm from a statistics document
+func currentPeriodValues(doc map[string]interface{}, period string, tm time.Time) map[string]interface{} {
+	if period == "day" {
+		dy, _ := doc["_dy"].(map[string]interface{})
+		return dy
+	}
+
+	hr, _ := doc["_hr"].(map[string]interface{})
+	h, _ := hr[fmt.Sprintf("h_%d", tm.Hour())].(map[string]interface{})
+	if period == "hour" {
+		return h
+	}
+
+	// 15 minute aggregation
+	mn, _ := h["mn"].(map[string]interface{})
+	m, _ := mn[fmt.Sprintf("m_%d", int(tm.Minute()/15.0)*15)].(map[string]interface{})
+	return m
+}
+
+// Returns the sample count field of timers and gauges, or blank
+func currentCountField(field string) string {
+	if strings.HasPrefix(field, "t_") {
+		return "tc_" + strings.TrimPrefix(field, "t_")
+	} else if strings.HasPrefix(field, "g_") {
+		return "gc_" + strings.TrimPrefix(field, "g_")
+	}
+	return ""
+}
+
+// Returns a numeric value, 0 if not found
+func currentValue(values map[string]interface{}, field string) float64 {
+	switch v := values[field].(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package info
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCurrentPeriodValues(t *testing.T) {
+	doc := map[string]interface{}{
+		"_dy": map[string]interface{}{"c_ct": float64(30)},
+		"_hr": map[string]interface{}{
+			"h_18": map[string]interface{}{
+				"c_ct": float64(20),
+				"mn": map[string]interface{}{
+					"m_15": map[string]interface{}{"c_ct": float64(10)},
+				},
+			},
+		},
+	}
+	tm := time.Date(2001, 2, 10, 18, 22, 0, 0, time.UTC)
+
+	for period, expected := range map[string]float64{"day": 30, "hour": 20, "minute": 10} {
+		if v := currentValue(currentPeriodValues(doc, period, tm), "c_ct"); v != expected {
+			t.Errorf("%s: expected %f, got %f", period, expected, v)
+		}
+	}
+
+	// no data on the period
+	tm = time.Date(2001, 2, 10, 19, 0, 0, 0, time.UTC)
+	if v := currentValue(currentPeriodValues(doc, "minute", tm), "c_ct"); v != 0 {
+		t.Errorf("expected 0 for a period without data, got %f", v)
+	}
+}
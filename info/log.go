@@ -1,13 +1,20 @@
 package info
 
 import (
+	"fmt"
 	"github.com/RangelReale/appstatsd/data"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"strconv"
 )
 
 type LogQuery struct {
-	Amount int
-	App    string
+	Amount    int
+	App       string
+	Level     data.LogLevel // if > 0, only this level or more severe
+	MessageId string
+	Fields    map[string]string // filter on structured fields
+	Apps      []string          // if not nil, only these apps can be returned
 }
 
 func QueryLog(db *mgo.Database, logquery *LogQuery) ([]*data.LogData, error) {
@@ -24,9 +31,47 @@ func QueryLog(db *mgo.Database, logquery *LogQuery) ([]*data.LogData, error) {
 		Sparse:     true,
 	})
 
+	filter, err := logQueryFilter(logquery)
+	if err != nil {
+		return nil, err
+	}
+
+	fdata := make([]*data.LogData, 0)
+
+	query := c_log.Find(filter).Sort("-dt").Limit(amount).Iter()
+	var flog *data.LogData
+
+	for query.Next(&flog) {
+		fdata = append(fdata, flog)
+		flog = nil
+	}
+
+	if err := query.Close(); err != nil {
+		return nil, err
+	}
+
+	return fdata, nil
+}
+
+// Returns log records inserted after the record with id sinceid, oldest first.
+// If sinceid is blank, returns from the first record.
+func QueryLogSince(db *mgo.Database, logquery *LogQuery, sinceid bson.ObjectId) ([]*data.LogData, error) {
+	amount := logquery.Amount
+	if amount < 0 {
+		amount = 100
+	}
+
+	filter, err := logQueryFilter(logquery)
+	if err != nil {
+		return nil, err
+	}
+	if sinceid != "" {
+		filter["_id"] = bson.M{"$gt": sinceid}
+	}
+
 	fdata := make([]*data.LogData, 0)
 
-	query := c_log.Find(nil).Sort("-dt").Limit(amount).Iter()
+	query := db.C("log").Find(filter).Sort("_id").Limit(amount).Iter()
 	var flog *data.LogData
 
 	for query.Next(&flog) {
@@ -40,3 +85,53 @@ func QueryLog(db *mgo.Database, logquery *LogQuery) ([]*data.LogData, error) {
 
 	return fdata, nil
 }
+
+// Returns the id of the last inserted log record, or blank if none found
+func QueryLogLastId(db *mgo.Database, logquery *LogQuery) (bson.ObjectId, error) {
+	filter, err := logQueryFilter(logquery)
+	if err != nil {
+		return "", err
+	}
+
+	var flog data.LogData
+	err = db.C("log").Find(filter).Sort("-_id").Limit(1).One(&flog)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return flog.Id, nil
+}
+
+// build mongodb filter
+func logQueryFilter(logquery *LogQuery) (bson.M, error) {
+	filter := bson.M{}
+	if logquery.App != "" {
+		if logquery.Apps != nil && !appAllowed(logquery.Apps, logquery.App) {
+			return nil, fmt.Errorf("Access denied to app: %s", logquery.App)
+		}
+		filter["app"] = logquery.App
+	} else if logquery.Apps != nil {
+		filter["app"] = bson.M{"$in": logquery.Apps}
+	}
+	if logquery.Level > 0 {
+		filter["lv"] = bson.M{"$lte": logquery.Level}
+	}
+	if logquery.MessageId != "" {
+		filter["mid"] = logquery.MessageId
+	}
+	for fn, fv := range logquery.Fields {
+		// sanitize
+		if !data.ValidateValueName(fn) {
+			return nil, fmt.Errorf("Invalid field name - name not validated: %s", fn)
+		}
+
+		// field values may have been sent as numbers
+		if fvnum, err := strconv.ParseFloat(fv, 64); err == nil {
+			filter["fields."+fn] = bson.M{"$in": []interface{}{fv, fvnum}}
+		} else {
+			filter["fields."+fn] = fv
+		}
+	}
+	return filter, nil
+}
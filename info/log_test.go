@@ -0,0 +1,50 @@
+package info
+
+import (
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogQueryFilterApps(t *testing.T) {
+	filter, err := logQueryFilter(&LogQuery{Apps: []string{"app1", "app2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filter["app"], bson.M{"$in": []string{"app1", "app2"}}) {
+		t.Errorf("unexpected app filter: %v", filter["app"])
+	}
+
+	filter, err = logQueryFilter(&LogQuery{App: "app2", Apps: []string{"app1", "app2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter["app"] != "app2" {
+		t.Errorf("unexpected app filter: %v", filter["app"])
+	}
+
+	if _, err := logQueryFilter(&LogQuery{App: "app3", Apps: []string{"app1", "app2"}}); err == nil {
+		t.Error("app outside the allowed apps should return an error")
+	}
+}
+
+func TestLogSummaryCheckRange(t *testing.T) {
+	end := time.Now()
+	tests := []struct {
+		start time.Time
+		end   time.Time
+		ok    bool
+	}{
+		{end.Add(-24 * time.Hour), end, true},
+		{end.Add(-LogSummaryMaxRange), end, true},
+		{end.Add(-LogSummaryMaxRange - time.Hour), end, false},
+		{time.Time{}, end, false},
+		{end, end.Add(-time.Hour), false},
+	}
+	for _, tt := range tests {
+		if err := logSummaryCheckRange(tt.start, tt.end); (err == nil) != tt.ok {
+			t.Errorf("range %s - %s: expected ok=%t, got %v", tt.start, tt.end, tt.ok, err)
+		}
+	}
+}
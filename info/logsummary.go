@@ -0,0 +1,94 @@
+package info
+
+import (
+	"fmt"
+	"github.com/RangelReale/appstatsd/data"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"time"
+)
+
+// maximum time range of a log summary
+const LogSummaryMaxRange = 31 * 24 * time.Hour
+
+type LogSummaryQuery struct {
+	// log filters. Amount is the maximum number of groups returned
+	LogQuery
+
+	StartDate time.Time
+	EndDate   time.Time
+}
+
+// Log messages aggregated by app, level and message id
+type LogSummary struct {
+	App       string        `json:"app" bson:"app"`
+	Level     data.LogLevel `json:"level" bson:"lv"`
+	MessageId string        `json:"mid" bson:"mid"`
+	Count     int           `json:"count" bson:"ct"`
+	FirstDate time.Time     `json:"first" bson:"first"`
+	LastDate  time.Time     `json:"last" bson:"last"`
+	Sample    string        `json:"sample" bson:"sample"`
+}
+
+// Groups log messages by app, level and message id, ordered by count.
+// Deduplicated messages are counted by their repeat count.
+// The sample is the newest message of the group.
+// The date range is required, and limited to LogSummaryMaxRange.
+func QueryLogSummary(db *mgo.Database, summaryquery *LogSummaryQuery) ([]*LogSummary, error) {
+	amount := summaryquery.Amount
+	if amount < 1 {
+		amount = 100
+	}
+
+	if err := logSummaryCheckRange(summaryquery.StartDate, summaryquery.EndDate); err != nil {
+		return nil, err
+	}
+
+	filter, err := logQueryFilter(&summaryquery.LogQuery)
+	if err != nil {
+		return nil, err
+	}
+	filter["dt"] = bson.M{"$gte": summaryquery.StartDate, "$lt": summaryquery.EndDate}
+
+	pipeline := []bson.M{
+		{"$match": filter},
+		{"$sort": bson.M{"dt": -1}},
+		{"$group": bson.M{
+			"_id":    bson.M{"app": "$app", "lv": "$lv", "mid": "$mid"},
+			"ct":     bson.M{"$sum": bson.M{"$ifNull": []interface{}{"$rc", 1}}},
+			"first":  bson.M{"$min": "$dt"},
+			"last":   bson.M{"$max": bson.M{"$ifNull": []interface{}{"$ldt", "$dt"}}},
+			"sample": bson.M{"$first": "$m"},
+		}},
+		{"$sort": bson.M{"ct": -1}},
+		{"$limit": amount},
+		{"$project": bson.M{
+			"_id":    0,
+			"app":    "$_id.app",
+			"lv":     "$_id.lv",
+			"mid":    "$_id.mid",
+			"ct":     1,
+			"first":  1,
+			"last":   1,
+			"sample": 1,
+		}},
+	}
+
+	fdata := make([]*LogSummary, 0)
+	// the groups can exceed the aggregation memory limit
+	if err := db.C("log").Pipe(pipeline).AllowDiskUse().All(&fdata); err != nil {
+		return nil, err
+	}
+
+	return fdata, nil
+}
+
+func logSummaryCheckRange(start, end time.Time) error {
+	if start.IsZero() || end.IsZero() || !start.Before(end) {
+		return fmt.Errorf("Invalid date range - start must be before end")
+	}
+	if end.Sub(start) > LogSummaryMaxRange {
+		return fmt.Errorf("Invalid date range - cannot be longer than %d days", int(LogSummaryMaxRange.Hours()/24))
+	}
+	return nil
+}
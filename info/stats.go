@@ -19,6 +19,7 @@ type StatsQuery struct {
 	Groups  []string
 	Amount  int
 	App     string
+	Apps    []string // if not nil, only these apps can be returned
 }
 
 type StatsQueryResult struct {
@@ -42,7 +43,8 @@ func QueryStats(db *mgo.Database, statsquery *StatsQuery) (*StatsQueryResult, er
 	if !data.ValidateValueName(statsquery.Process) {
 		return nil, fmt.Errorf("Invalid process name - name not validated: %s", statsquery.Process)
 	}
-	if statsquery.App != "" && statsquery.App != "@" && !data.ValidateName(statsquery.App) {
+	// internal apps start with underline
+	if statsquery.App != "" && statsquery.App != "@" && !data.ValidateName(strings.TrimPrefix(statsquery.App, "_")) {
 		return nil, fmt.Errorf("Invalid app name - name not validated: %s", statsquery.App)
 	}
 	for _, gval := range statsquery.Groups {
@@ -55,6 +57,15 @@ func QueryStats(db *mgo.Database, statsquery *StatsQuery) (*StatsQueryResult, er
 		statsquery.Amount = 1
 	}
 
+	// global statistics contain data of all apps, restricted queries must use the per-app ones
+	if statsquery.Apps != nil {
+		if statsquery.App == "" {
+			statsquery.App = "@"
+		} else if statsquery.App != "@" && !appAllowed(statsquery.Apps, statsquery.App) {
+			return nil, fmt.Errorf("Access denied to app: %s", statsquery.App)
+		}
+	}
+
 	// find collection
 	cname := fmt.Sprintf("stat_%s", statsquery.Process)
 	if statsquery.App != "" {
@@ -87,20 +98,9 @@ func QueryStats(db *mgo.Database, statsquery *StatsQuery) (*StatsQueryResult, er
 	//log.Printf("StartDate: %s - EndDate: %s", startdate.String(), enddate.String())
 
 	// build mongodb filter
-	filter := bson.M{"_dt": bson.M{"$gte": startdate.String()}}
-	if statsquery.App != "" && statsquery.App != "@" {
-		filter["_app"] = statsquery.App
-	}
-
-	if statsquery.Filters != nil {
-		for pn, pv := range statsquery.Filters {
-			// sanitize
-			if !data.ValidateValueName(pn) {
-				return nil, fmt.Errorf("Invalid filter name - name not validated: %s", pn)
-			}
-			//log.Printf("Filter: %s = %s", pn, pv)
-			filter[pn] = pv
-		}
+	filter, err := statsQueryFilter(statsquery, startdate)
+	if err != nil {
+		return nil, err
 	}
 
 	querysort := []string{"_dt"}
@@ -282,3 +282,24 @@ func (s InfoResult) Ticks() []plot.Tick {
 	}
 	return ret
 }
+
+// Builds the mongodb filter of the query, starting at startdate
+func statsQueryFilter(statsquery *StatsQuery, startdate epochdate.Date) (bson.M, error) {
+	filter := bson.M{}
+	for pn, pv := range statsquery.Filters {
+		// sanitize. internal keys like _dt and _app cannot be filtered, they would replace the app restriction
+		if strings.HasPrefix(pn, "_") || !data.ValidateValueName(pn) {
+			return nil, fmt.Errorf("Invalid filter name - name not validated: %s", pn)
+		}
+		//log.Printf("Filter: %s = %s", pn, pv)
+		filter[pn] = pv
+	}
+
+	filter["_dt"] = bson.M{"$gte": startdate.String()}
+	if statsquery.App != "" && statsquery.App != "@" {
+		filter["_app"] = statsquery.App
+	} else if statsquery.Apps != nil {
+		filter["_app"] = bson.M{"$in": statsquery.Apps}
+	}
+	return filter, nil
+}
@@ -0,0 +1,30 @@
+package info
+
+import (
+	"github.com/RangelReale/epochdate"
+	"gopkg.in/mgo.v2/bson"
+	"reflect"
+	"testing"
+)
+
+func TestStatsQueryFilterApps(t *testing.T) {
+	startdate, _ := epochdate.NewFromDate(2001, 2, 10)
+
+	// restricted queries use the per-app statistics of the allowed apps
+	q := &StatsQuery{App: "@", Apps: []string{"app1"}, Filters: map[string]string{"proj": "p1"}}
+	filter, err := statsQueryFilter(q, startdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(filter["_app"], bson.M{"$in": []string{"app1"}}) || filter["proj"] != "p1" {
+		t.Errorf("unexpected filter: %v", filter)
+	}
+
+	// f__app and f__dt cannot replace the app restriction or the date
+	for _, name := range []string{"_app", "_dt"} {
+		q := &StatsQuery{App: "@", Apps: []string{"app1"}, Filters: map[string]string{name: "otherapp"}}
+		if _, err := statsQueryFilter(q, startdate); err == nil {
+			t.Errorf("filter on %s should return an error", name)
+		}
+	}
+}
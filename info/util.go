@@ -27,3 +27,13 @@ func SplitParams(params string) []string {
 
 	return strings.Split(params, ",")
 }
+
+// Checks if app is on the list of allowed apps
+func appAllowed(apps []string, app string) bool {
+	for _, a := range apps {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
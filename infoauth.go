@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/RangelReale/appstatsd/infohttp"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Authentication settings, which can be reloaded
+type authConfig struct {
+	tokens      []AuthToken
+	users       []AuthUser
+	proxyheader string
+	proxyaddrs  []string
+}
+
+func currentAuthConfig() *authConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	return &authConfig{
+		tokens:      Configuration.AuthTokens,
+		users:       Configuration.AuthUsers,
+		proxyheader: Configuration.AuthProxyHeader,
+		proxyaddrs:  Configuration.AuthProxyAddrs,
+	}
+}
+
+// Checks if any authentication method is configured
+func (a *authConfig) enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0 || a.proxyheader != ""
+}
+
+// Authenticates the request, using in order the trusted proxy header, the api token
+// (Authorization: Bearer TOKEN, or the "token" parameter on /log/stream) or http basic.
+// Returns the apps the request can access, nil for all.
+// If not authenticated, the error response is written and ok is false.
+func authRequest(w http.ResponseWriter, r *http.Request) (apps []string, ok bool) {
+	a := currentAuthConfig()
+	if !a.enabled() {
+		return nil, true
+	}
+
+	if a.proxyheader != "" && a.trustedProxy(r.RemoteAddr) {
+		if username := r.Header.Get(a.proxyheader); username != "" {
+			if user := a.findUser(username); user != nil {
+				return authApps(user.Apps), true
+			}
+			log.Warning("Unknown proxy user %s from %s", username, r.RemoteAddr)
+			handleUnauthorized(w, r)
+			return nil, false
+		}
+	}
+
+	var token string
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	} else if r.URL.Path == "/log/stream" {
+		// EventSource cannot send headers. Only accepted here, as urls are written to access logs
+		token = r.URL.Query().Get("token")
+	}
+	if token != "" {
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+				return authApps(t.Apps), true
+			}
+		}
+		log.Warning("Invalid api token from %s", r.RemoteAddr)
+		handleUnauthorized(w, r)
+		return nil, false
+	}
+
+	if username, password, hasbasic := r.BasicAuth(); hasbasic {
+		user := a.findUser(username)
+		if user != nil && user.PasswordHash != "" &&
+			bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil {
+			return authApps(user.Apps), true
+		}
+		log.Warning("Invalid password for user %s from %s", username, r.RemoteAddr)
+	}
+
+	handleUnauthorized(w, r)
+	return nil, false
+}
+
+func (a *authConfig) findUser(username string) *AuthUser {
+	for i := range a.users {
+		if a.users[i].Username == username {
+			return &a.users[i]
+		}
+	}
+	return nil
+}
+
+// Empty app list allows all apps
+func authApps(apps []string) []string {
+	if len(apps) == 0 {
+		return nil
+	}
+	return apps
+}
+
+// Checks if the remote address is one of the trusted proxies
+func (a *authConfig) trustedProxy(remoteaddr string) bool {
+	host, _, err := net.SplitHostPort(remoteaddr)
+	if err != nil {
+		host = remoteaddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, addr := range a.proxyaddrs {
+		if strings.Contains(addr, "/") {
+			if _, ipnet, err := net.ParseCIDR(addr); err == nil && ipnet.Contains(ip) {
+				return true
+			}
+		} else if pip := net.ParseIP(addr); pip != nil && pip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleUnauthorized(w http.ResponseWriter, r *http.Request) {
+	configMu.RLock()
+	basic := len(Configuration.AuthUsers) > 0
+	configMu.RUnlock()
+
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="appstatsd"`)
+	}
+
+	stenc, eerr := json.Marshal(infohttp.InfoResponse{ErrorCode: 401, ErrorMessage: "Unauthorized"})
+	if eerr != nil {
+		http.Error(w, "Error: Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(stenc)
+}
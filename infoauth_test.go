@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthRequestTokenParameter(t *testing.T) {
+	defer func(tokens []AuthToken) {
+		Configuration.AuthTokens = tokens
+	}(Configuration.AuthTokens)
+	Configuration.AuthTokens = []AuthToken{{Token: "secret"}}
+
+	tests := []struct {
+		url    string
+		bearer bool
+		ok     bool
+	}{
+		{"/log/stream?token=secret", false, true},
+		{"/log?token=secret", false, false},
+		{"/stats/conn?token=secret", false, false},
+		{"/log", true, true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		if tt.bearer {
+			r.Header.Set("Authorization", "Bearer secret")
+		}
+		w := httptest.NewRecorder()
+		if _, ok := authRequest(w, r); ok != tt.ok {
+			t.Errorf("%s: expected ok=%t", tt.url, tt.ok)
+		} else if !ok && w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status 401, got %d", tt.url, w.Code)
+		}
+	}
+}
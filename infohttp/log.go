@@ -3,24 +3,18 @@ package infohttp
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/RangelReale/appstatsd/data"
 	"github.com/RangelReale/appstatsd/info"
 	"gopkg.in/mgo.v2"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
-func HandleLog(db *mgo.Database, w http.ResponseWriter, r *http.Request) error {
-	// amount of records
-	amount := 100
-	if r.Form.Get("amount") != "" {
-		pamount, err := strconv.ParseInt(r.Form.Get("amount"), 10, 16)
-		if err == nil {
-			amount = int(pamount)
-		}
-	}
-
+// Returns log records. If apps is not nil, only records of these apps are returned.
+func HandleLog(db *mgo.Database, apps []string, w http.ResponseWriter, r *http.Request) error {
 	// do query
-	fdata, err := info.QueryLog(db, &info.LogQuery{Amount: amount, App: ""})
+	fdata, err := info.QueryLog(db, logQueryFromRequest(r, apps))
 	if err != nil {
 		return fmt.Errorf("Error reading data: %s", err)
 	}
@@ -42,3 +36,40 @@ func HandleLog(db *mgo.Database, w http.ResponseWriter, r *http.Request) error {
 
 	return nil
 }
+
+// Build log query from request parameters: amount, app, level, mid, f_FIELD.
+// apps restricts the apps that can be returned, nil for all.
+func logQueryFromRequest(r *http.Request, apps []string) *info.LogQuery {
+	r.ParseForm()
+
+	q := &info.LogQuery{
+		Amount:    100,
+		App:       r.Form.Get("app"),
+		MessageId: r.Form.Get("mid"),
+		Fields:    make(map[string]string),
+		Apps:      apps,
+	}
+
+	// amount of records
+	if r.Form.Get("amount") != "" {
+		pamount, err := strconv.ParseInt(r.Form.Get("amount"), 10, 16)
+		if err == nil {
+			q.Amount = int(pamount)
+		}
+	}
+	if r.Form.Get("level") != "" {
+		plevel, err := strconv.ParseInt(r.Form.Get("level"), 10, 16)
+		if err == nil {
+			q.Level = data.LogLevel(plevel)
+		}
+	}
+
+	// field filters
+	for fname, _ := range r.Form {
+		if strings.HasPrefix(fname, "f_") {
+			q.Fields[strings.TrimPrefix(fname, "f_")] = r.Form.Get(fname)
+		}
+	}
+
+	return q
+}
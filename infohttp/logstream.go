@@ -0,0 +1,94 @@
+package infohttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RangelReale/appstatsd/info"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"net/http"
+	"time"
+)
+
+var (
+	// interval between checks for new log records
+	LogStreamInterval = time.Second
+	// interval to send a keep-alive comment if no records were sent
+	LogStreamKeepAlive = 15 * time.Second
+)
+
+// Streams new log records as Server-Sent Events, until the client disconnects.
+// Accepts the same filters as HandleLog. The "amount" parameter limits the
+// records sent on each check. If apps is not nil, only records of these apps are sent.
+func HandleLogStream(db *mgo.Database, apps []string, w http.ResponseWriter, r *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("Streaming not supported")
+	}
+
+	q := logQueryFromRequest(r, apps)
+	if q.Amount < 1 {
+		q.Amount = 100
+	}
+
+	// start after the last received event if reconnecting, else from the newest record
+	var lastid bson.ObjectId
+	if leid := r.Header.Get("Last-Event-ID"); leid != "" && bson.IsObjectIdHex(leid) {
+		lastid = bson.ObjectIdHex(leid)
+	} else {
+		var err error
+		lastid, err = info.QueryLogLastId(db, q)
+		if err != nil {
+			return fmt.Errorf("Error reading data: %s", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(LogStreamInterval)
+	defer ticker.Stop()
+
+	lastsend := time.Now()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		fdata, err := info.QueryLogSince(db, q, lastid)
+		if err != nil {
+			// headers were already sent, report error as an event and finish
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+			flusher.Flush()
+			return nil
+		}
+
+		for _, flog := range fdata {
+			stenc, err := json.Marshal(flog)
+			if err != nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+				flusher.Flush()
+				return nil
+			}
+
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", flog.Id.Hex(), stenc); err != nil {
+				return nil
+			}
+			lastid = flog.Id
+		}
+
+		if len(fdata) > 0 {
+			lastsend = time.Now()
+		} else if time.Since(lastsend) >= LogStreamKeepAlive {
+			if _, err := fmt.Fprint(w, ":\n\n"); err != nil {
+				return nil
+			}
+			lastsend = time.Now()
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,68 @@
+package infohttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/RangelReale/appstatsd/info"
+	"gopkg.in/mgo.v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Returns log messages grouped by app, level and message id.
+// If apps is not nil, only records of these apps are summarized.
+func HandleLogSummary(db *mgo.Database, apps []string, w http.ResponseWriter, r *http.Request) error {
+	q := &info.LogSummaryQuery{
+		LogQuery: *logQueryFromRequest(r, apps),
+		EndDate:  time.Now(),
+	}
+
+	// time range: end defaults to now, start defaults to "hours" before end (default 24)
+	if r.Form.Get("end") != "" {
+		pend, err := time.Parse(time.RFC3339, r.Form.Get("end"))
+		if err != nil {
+			return fmt.Errorf("Invalid end date: %s", err)
+		}
+		q.EndDate = pend
+	}
+	if r.Form.Get("start") != "" {
+		pstart, err := time.Parse(time.RFC3339, r.Form.Get("start"))
+		if err != nil {
+			return fmt.Errorf("Invalid start date: %s", err)
+		}
+		q.StartDate = pstart
+	} else {
+		hours := 24
+		if r.Form.Get("hours") != "" {
+			phours, err := strconv.ParseInt(r.Form.Get("hours"), 10, 16)
+			if err == nil && phours > 0 {
+				hours = int(phours)
+			}
+		}
+		q.StartDate = q.EndDate.Add(-time.Duration(hours) * time.Hour)
+	}
+
+	// do query
+	fdata, err := info.QueryLogSummary(db, q)
+	if err != nil {
+		return fmt.Errorf("Error reading data: %s", err)
+	}
+
+	// output json data
+	stenc, err := json.Marshal(
+		InfoResponse{
+			ErrorCode: 0,
+			Data: InfoResultRaw{
+				List: fdata,
+			},
+		})
+	if err != nil {
+		return fmt.Errorf("Error encoding json data: %s", err)
+	}
+
+	w.Header().Add("Content-Type", "application/json; charset=utf-8")
+	w.Write(stenc)
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package infohttp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/RangelReale/appstatsd/info"
+	"gopkg.in/mgo.v2"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Statistics exported as Prometheus metrics, one metric per field named NAME_FIELD
+type MetricsRule struct {
+	Process string            // statistics process, like "conn" for stat_conn
+	Name    string            // metric name prefix, defaults to appstatsd_PROCESS
+	Data    []string          // fields, like c_ct or t_dr
+	Period  string            // current day, hour or minute (15 minutes), defaults to minute
+	App     bool              // use the per-app statistics, with the app as the "app" label
+	Labels  map[string]string // parameter to label name, values of other parameters are summed
+}
+
+// Returns the metric name prefix of the rule
+func (m *MetricsRule) MetricName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return "appstatsd_" + m.Process
+}
+
+// Returns the current period values of the rules in the Prometheus text format.
+// If apps is not nil, only per-app rules are returned, with data of these apps.
+func HandleMetrics(db *mgo.Database, rules []MetricsRule, apps []string, w http.ResponseWriter, r *http.Request) error {
+	// write to a buffer, so errors are not sent as partial output
+	var buf bytes.Buffer
+	for i := range rules {
+		rule := &rules[i]
+		if apps != nil && !rule.App {
+			continue
+		}
+
+		q := &info.CurrentQuery{
+			Process: rule.Process,
+			Data:    rule.Data,
+			Period:  rule.Period,
+			App:     rule.App,
+			Apps:    apps,
+		}
+		if q.Period == "" {
+			q.Period = "minute"
+		}
+		if rule.App {
+			q.Groups = append(q.Groups, "_app")
+		}
+		for param := range rule.Labels {
+			q.Groups = append(q.Groups, param)
+		}
+
+		res, err := info.QueryCurrent(db, q)
+		if err != nil {
+			return fmt.Errorf("Error reading data of %s: %s", rule.Process, err)
+		}
+
+		WriteMetrics(&buf, rule, res)
+	}
+
+	w.Header().Add("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+
+	return nil
+}
+
+// Writes query results in the Prometheus text format
+func WriteMetrics(w io.Writer, rule *MetricsRule, results []*info.CurrentResult) {
+	for _, field := range rule.Data {
+		name := metricsName(rule.MetricName() + "_" + field)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+
+		for _, res := range results {
+			var labels []string
+			for g, gv := range res.Groups {
+				lname := "app"
+				if g != "_app" {
+					lname = rule.Labels[g]
+				}
+				labels = append(labels, fmt.Sprintf("%s=\"%s\"", lname, metricsLabelEscape(fmt.Sprintf("%v", gv))))
+			}
+			sort.Strings(labels)
+
+			if len(labels) > 0 {
+				fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(labels, ","), strconv.FormatFloat(res.Values[field], 'g', -1, 64))
+			} else {
+				fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(res.Values[field], 'g', -1, 64))
+			}
+		}
+	}
+}
+
+// Replaces characters not allowed in metric names
+func metricsName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+var metricsLabelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsLabelEscape(value string) string {
+	return metricsLabelReplacer.Replace(value)
+}
@@ -0,0 +1,34 @@
+package infohttp
+
+import (
+	"bytes"
+	"github.com/RangelReale/appstatsd/info"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	rule := &MetricsRule{
+		Process: "conn",
+		Data:    []string{"c_ct", "t_dr"},
+		App:     true,
+		Labels:  map[string]string{"conn": "project"},
+	}
+	results := []*info.CurrentResult{
+		{
+			Groups: map[string]interface{}{"_app": "app1", "conn": `p"1`},
+			Values: map[string]float64{"c_ct": 20, "t_dr": 1.5},
+		},
+	}
+
+	var buf bytes.Buffer
+	WriteMetrics(&buf, rule, results)
+
+	expected := `# TYPE appstatsd_conn_c_ct gauge
+appstatsd_conn_c_ct{app="app1",project="p\"1"} 20
+# TYPE appstatsd_conn_t_dr gauge
+appstatsd_conn_t_dr{app="app1",project="p\"1"} 1.5
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
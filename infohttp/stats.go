@@ -17,7 +17,9 @@ import (
 	"gopkg.in/mgo.v2"
 )
 
-func HandleStats(process string, db *mgo.Database, w http.ResponseWriter, r *http.Request) error {
+// Returns statistics of the process. If apps is not nil, only statistics of these apps
+// are returned, using the per-app statistics.
+func HandleStats(process string, db *mgo.Database, apps []string, w http.ResponseWriter, r *http.Request) error {
 	r.ParseForm()
 
 	amount := 2
@@ -57,6 +59,7 @@ func HandleStats(process string, db *mgo.Database, w http.ResponseWriter, r *htt
 		Groups:  info.SplitParams(r.Form.Get("group")),
 		Amount:  amount,
 		App:     r.Form.Get("app"),
+		Apps:    apps,
 	}
 
 	output := r.Form.Get("output") // json, chart
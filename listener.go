@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// handlers in progress on all listeners, waited for on shutdown
+var listenerHandlers sync.WaitGroup
+
+// Receives datagrams from a packet connection, calling handler on a new
+// goroutine for each one. Datagrams larger than maxsize are truncated.
+// The name is used in the packet counter of the listener.
+// Returns when the connection is closed, which is done on shutdown.
+func ReceivePackets(name string, c net.PacketConn, maxsize int, handler func(addr net.Addr, msg []byte)) {
+	shutdownRegister(c)
+
+	packets := fmt.Sprintf(systemListenerPackets, name)
+
+	msg := make([]byte, maxsize)
+	for {
+		nbytes, addr, err := c.ReadFrom(msg)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if ne, ok := err.(net.Error); ok && !ne.Temporary() {
+				log.Error("Error reading from %s: %s", c.LocalAddr(), err)
+				return
+			}
+			log.Error("%s", err)
+			continue
+		}
+		buf := make([]byte, nbytes)
+		copy(buf, msg[:nbytes])
+		SystemCount(packets, 1)
+
+		listenerHandlers.Add(1)
+		go func() {
+			defer listenerHandlers.Done()
+			handler(addr, buf)
+		}()
+	}
+}
+
+// Receives delimited messages from stream connections.
+// Each connection is handled on its own goroutine, and its messages are
+// sent to Handler in order.
+type StreamServer struct {
+	Name           string // used in the message counter of the listener
+	Listener       net.Listener
+	MaxMessageSize int
+	Split          bufio.SplitFunc // defaults to bufio.ScanLines
+	Handler        func(addr net.Addr, msg []byte)
+	MaxConnections int           // 0 for no limit
+	IdleTimeout    time.Duration // 0 for no timeout
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// Accepts connections until the server is closed, which is done on shutdown
+func (s *StreamServer) Serve() error {
+	shutdownRegister(s)
+
+	var connsem chan struct{}
+	if s.MaxConnections > 0 {
+		connsem = make(chan struct{}, s.MaxConnections)
+	}
+
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Error("Error accepting connection: %s", err)
+				continue
+			}
+			return err
+		}
+
+		if connsem != nil {
+			select {
+			case connsem <- struct{}{}:
+			default:
+				log.Warning("Connection limit of %d reached, closing connection from %s", s.MaxConnections, conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+		}
+
+		if !s.trackConn(conn, true) {
+			conn.Close()
+			return nil
+		}
+
+		listenerHandlers.Add(1)
+		go func() {
+			defer listenerHandlers.Done()
+			s.handleConn(conn)
+			s.trackConn(conn, false)
+			if connsem != nil {
+				<-connsem
+			}
+		}()
+	}
+}
+
+// Stops accepting connections, and closes the active ones
+func (s *StreamServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return s.Listener.Close()
+}
+
+func (s *StreamServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Adds or removes an active connection. Returns false if the server is closed.
+func (s *StreamServer) trackConn(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *StreamServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	packets := fmt.Sprintf(systemListenerPackets, s.Name)
+
+	// the scanner accepts messages up to the larger of the buffer capacity and the maximum size
+	bufsize := 4096
+	if s.MaxMessageSize < bufsize {
+		bufsize = s.MaxMessageSize
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, bufsize), s.MaxMessageSize)
+	if s.Split != nil {
+		scanner.Split(s.Split)
+	}
+
+	for {
+		if s.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(s.IdleTimeout))
+		}
+		if !scanner.Scan() {
+			break
+		}
+
+		// scanner reuses its buffer
+		msg := make([]byte, len(scanner.Bytes()))
+		copy(msg, scanner.Bytes())
+		SystemCount(packets, 1)
+		s.Handler(conn.RemoteAddr(), msg)
+	}
+
+	if err := scanner.Err(); err != nil {
+		if s.isClosed() {
+			return
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			log.Debug("Closing idle connection from %s", conn.RemoteAddr())
+		} else {
+			log.Error("Error reading from %s: %s", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// Split function for octet-counted records: LEN SP RECORD.
+// Newlines between records are ignored.
+func ScanOctetCounted(buf []byte, atEOF bool) (advance int, token []byte, err error) {
+	// skip newlines between records
+	for advance < len(buf) && (buf[advance] == '\n' || buf[advance] == '\r') {
+		advance++
+	}
+	if advance > 0 || len(buf) == 0 {
+		return advance, nil, nil
+	}
+
+	sp := bytes.IndexByte(buf, ' ')
+	if sp < 0 {
+		if atEOF {
+			return 0, nil, fmt.Errorf("invalid octet-counted frame")
+		}
+		return 0, nil, nil
+	}
+	msglen, err := strconv.Atoi(string(buf[:sp]))
+	if err != nil || msglen <= 0 {
+		return 0, nil, fmt.Errorf("invalid octet-counted frame length: %q", buf[:sp])
+	}
+	if len(buf) < sp+1+msglen {
+		if atEOF {
+			return 0, nil, fmt.Errorf("incomplete octet-counted frame")
+		}
+		return 0, nil, nil
+	}
+	return sp + 1 + msglen, buf[sp+1 : sp+1+msglen], nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStreamServerClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	ss := &StreamServer{
+		Listener:       l,
+		MaxMessageSize: 1024,
+		Handler: func(addr net.Addr, msg []byte) {
+			received <- string(msg)
+		},
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- ss.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("app1:2::Error\n"))
+
+	select {
+	case msg := <-received:
+		if msg != "app1:2::Error" {
+			t.Errorf("unexpected message %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+
+	// closing the server closes the active connection
+	ss.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve should return nil after Close, got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		listenerHandlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("connection handler did not finish after Close")
+	}
+}
+
+func TestStreamServerMaxMessageSize(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 2)
+	ss := &StreamServer{
+		Listener:       l,
+		MaxMessageSize: 16,
+		Handler: func(addr net.Addr, msg []byte) {
+			received <- string(msg)
+		},
+	}
+	go ss.Serve()
+	defer ss.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("app1:2::Error\napp1:2::A message larger than the limit\n"))
+
+	select {
+	case msg := <-received:
+		if msg != "app1:2::Error" {
+			t.Errorf("unexpected message %q", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not received")
+	}
+	select {
+	case msg := <-received:
+		t.Errorf("message larger than the limit should not be received, got %q", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReceivePacketsClose(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		ReceivePackets("test", c, 1024, func(addr net.Addr, msg []byte) {})
+		close(finished)
+	}()
+
+	c.Close()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("ReceivePackets did not return after Close")
+	}
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"github.com/RangelReale/appstatsd/data"
 	"github.com/RangelReale/gostatsd/statsd"
 	"io"
 	"net"
+	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Receive log messages via udp
+// Receive log messages via udp, and optionally tcp and unix socket
 func ServerLog() {
+	if Configuration.LogTCPPort != 0 {
+		go serverLogTCP()
+	}
+	if Configuration.LogUnixSocket != "" {
+		go serverLogUnix()
+	}
+
 	c, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", Configuration.ListenHost, Configuration.LogPort))
 	if err != nil {
 		log.Fatal("Error creating log server: %s", err.Error())
@@ -20,73 +32,188 @@ func ServerLog() {
 
 	defer c.Close()
 
-	msg := make([]byte, 1024)
-	for {
-		nbytes, addr, err := c.ReadFrom(msg)
+	ReceivePackets("log", c, int(Configuration.LogMaxMessageSize), func(addr net.Addr, msg []byte) {
+		if payload, authapp, ok := PacketAuth("log", addr, msg); ok {
+			serverLogHandleMessage(addr, payload, authapp)
+		}
+	})
+}
+
+// Receive newline-delimited log messages via tcp, with optional tls
+func serverLogTCP() {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", Configuration.ListenHost, Configuration.LogTCPPort))
+	if err != nil {
+		log.Fatal("Error creating log tcp server: %s", err.Error())
+	}
+
+	if Configuration.LogTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(Configuration.LogTLSCertFile, Configuration.LogTLSKeyFile)
 		if err != nil {
-			log.Error("%s", err)
-			continue
+			log.Fatal("Error loading log tcp server certificate: %s", err.Error())
 		}
-		buf := make([]byte, nbytes)
-		copy(buf, msg[:nbytes])
-		go serverLogHandleMessage(addr, buf)
+		l = tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	ss := &StreamServer{
+		Name:           "log_tcp",
+		Listener:       l,
+		MaxMessageSize: int(Configuration.LogMaxMessageSize),
+		Split:          serverLogSplit(),
+		Handler: func(addr net.Addr, line []byte) {
+			serverLogHandleLine(addr, line, "")
+		},
+	}
+	if err := ss.Serve(); err != nil {
+		log.Error("Error on log tcp server: %s", err)
 	}
-	panic("not reached")
 }
 
-func serverLogHandleMessage(addr net.Addr, msg []byte) {
-	buf := bytes.NewBuffer(msg)
-	for {
-		line, readerr := buf.ReadBytes('\n')
-
-		// don't require line to end in \n, if EOF use received line if valid
-		if readerr != nil && readerr != io.EOF {
-			log.Error("error reading message from %s: %s", addr, readerr)
-			return
-		} else if readerr != io.EOF {
-			// remove newline, only if not EOF
-			if len(line) > 0 {
-				line = line[:len(line)-1]
-			}
+// Receive log messages via unix socket, either datagram (unixgram) or newline-delimited stream (unix)
+func serverLogUnix() {
+	// remove socket file left from previous run
+	if _, err := os.Stat(Configuration.LogUnixSocket); err == nil {
+		if err := os.Remove(Configuration.LogUnixSocket); err != nil {
+			log.Fatal("Error removing log unix socket: %s", err.Error())
 		}
+	}
 
-		// Only process lines with more than one character
-		if len(line) > 1 {
-			ldata, err := serverLogParseLine(line)
-			if err != nil {
-				log.Error("error parsing line %q from %s: %s", line, addr, err)
-				continue
-			}
+	switch Configuration.LogUnixSocketType {
+	case "unix":
+		l, err := net.Listen("unix", Configuration.LogUnixSocket)
+		if err != nil {
+			log.Fatal("Error creating log unix socket server: %s", err.Error())
+		}
+		ss := &StreamServer{
+			Name:           "log_unix",
+			Listener:       l,
+			MaxMessageSize: int(Configuration.LogMaxMessageSize),
+			Split:          serverLogSplit(),
+			Handler: func(addr net.Addr, line []byte) {
+				serverLogHandleLine(addr, line, "")
+			},
+		}
+		if err := ss.Serve(); err != nil {
+			log.Error("Error on log unix socket server: %s", err)
+		}
+	case "unixgram":
+		c, err := net.ListenPacket("unixgram", Configuration.LogUnixSocket)
+		if err != nil {
+			log.Fatal("Error creating log unix socket server: %s", err.Error())
+		}
+		defer c.Close()
 
-			// send message to database
-			DatabaseChan <- DBMessage{log: ldata}
+		ReceivePackets("log_unix", c, int(Configuration.LogMaxMessageSize), func(addr net.Addr, msg []byte) {
+			serverLogHandleMessage(addr, msg, "")
+		})
+	default:
+		log.Fatal("Invalid log unix socket type: %s", Configuration.LogUnixSocketType)
+	}
+}
 
-			if Configuration.ErrorStatistics {
-				// log errors in "error"
-				if ldata.Level < data.WARNING {
-					DatabaseChan <- DBMessage{metrics: &statsd.Metric{
-						Type:   statsd.COUNTER,
-						Bucket: fmt.Sprintf("%s.error.ct", ldata.App),
-						Value:  1,
-					}}
-				} else if ldata.Level == data.WARNING {
+// Handles a datagram, which can contain multiple records.
+// If authapp is not blank, only records of this app are accepted.
+func serverLogHandleMessage(addr net.Addr, msg []byte, authapp string) {
+	scanner := bufio.NewScanner(bytes.NewReader(msg))
+	scanner.Buffer(make([]byte, 0, len(msg)+1), len(msg)+1)
+	scanner.Split(serverLogSplit())
+
+	for scanner.Scan() {
+		serverLogHandleLine(addr, scanner.Bytes(), authapp)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Error("error reading message from %s: %s", addr, err)
+	}
+}
+
+// Returns the split function for the configured framing.
+// "newline" separates records by newlines (don't require the last one to end in \n),
+// "octet" uses octet-counted records (LEN SP RECORD), which can contain newlines.
+func serverLogSplit() bufio.SplitFunc {
+	if Configuration.LogFraming == "octet" {
+		return ScanOctetCounted
+	}
+	return bufio.ScanLines
+}
+
+// Handles a single log record
+func serverLogHandleLine(addr net.Addr, line []byte, authapp string) {
+	// Only process lines with more than one character
+	if len(line) <= 1 {
+		return
+	}
+
+	var ldata *data.LogData
+	var err error
+	if line[0] == '{' {
+		ldata, err = serverLogParseJSON(line)
+	} else {
+		ldata, err = serverLogParseLine(line)
+	}
+	if err != nil {
+		log.Error("error parsing line %q from %s: %s", line, addr, err)
+		SystemCount(fmt.Sprintf(systemParseErrors, "log"), 1)
+		return
+	}
+
+	if !packetAuthAllowApp("log", addr, authapp, ldata.App) {
+		return
+	}
+
+	serverLogDispatch(ldata)
+}
+
+// Send parsed log message to database, and generate error statistics
+func serverLogDispatch(ldata *data.LogData) {
+	configMu.RLock()
+	filter := ingestFilter
+	errorstatistics := Configuration.ErrorStatistics
+	rules := Configuration.ErrorStatisticsRules
+	configMu.RUnlock()
+
+	if !filter.AllowLog(ldata.App) {
+		return
+	}
+	if !rateLimiter.Allow(ldata.App, RateLimitLogs) {
+		return
+	}
+
+	// send message to database
+	DatabaseChan <- DBMessage{log: ldata, date: ldata.Date}
+
+	if errorstatistics {
+		// count log levels in the configured buckets
+		for _, rule := range rules {
+			for _, level := range rule.Levels {
+				if ldata.Level == level {
 					DatabaseChan <- DBMessage{metrics: &statsd.Metric{
 						Type:   statsd.COUNTER,
-						Bucket: fmt.Sprintf("%s.error.wct", ldata.App),
+						Bucket: serverLogErrorStatisticsBucket(&rule, ldata),
 						Value:  1,
-					}}
+					}, date: ldata.Date}
+					break
 				}
 			}
 		}
+	}
+}
 
-		if readerr != nil && readerr == io.EOF {
-			// if was EOF, finished handling
-			return
+// APP.BUCKET, with the message id as parameter of the first info if requested
+func serverLogErrorStatisticsBucket(rule *ErrorStatisticsRule, ldata *data.LogData) string {
+	bucket := rule.Bucket
+	// message id cannot contain bucket separators
+	if rule.MessageId && ldata.MessageId != "" && !strings.ContainsAny(ldata.MessageId, ".#") {
+		if ipos := strings.IndexByte(bucket, '.'); ipos >= 0 {
+			bucket = bucket[:ipos] + "#" + ldata.MessageId + bucket[ipos:]
 		}
 	}
+	return fmt.Sprintf("%s.%s", ldata.App, bucket)
 }
 
 // APP:LEVEL:MESSAGEID:MESSAGE
+// The level can be followed by a unix timestamp in seconds: APP:LEVEL@TIMESTAMP:MESSAGEID:MESSAGE
+// The message can be followed by a tab and a json object with structured fields:
+// APP:LEVEL:MESSAGEID:MESSAGE\t{"key":"value"}
 func serverLogParseLine(line []byte) (*data.LogData, error) {
 	ldata := &data.LogData{Date: time.Now()}
 
@@ -102,7 +229,18 @@ func serverLogParseLine(line []byte) (*data.LogData, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error parsing log: %s", err)
 	}
-	levelint, err := strconv.ParseInt(string(level[:len(level)-1]), 10, 64)
+	levelstr := string(level[:len(level)-1])
+	if tpos := strings.IndexByte(levelstr, '@'); tpos >= 0 {
+		ldata.Date, err = parseUnixTimestamp(levelstr[tpos+1:])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing log: %s", err)
+		}
+		if err := validateTimestamp(ldata.Date); err != nil {
+			return nil, fmt.Errorf("error parsing log: %s", err)
+		}
+		levelstr = levelstr[:tpos]
+	}
+	levelint, err := strconv.ParseInt(levelstr, 10, 64)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing log: %s", err)
 	}
@@ -120,5 +258,136 @@ func serverLogParseLine(line []byte) (*data.LogData, error) {
 	}
 	ldata.Message = string(message[:len(message)])
 
+	// structured fields, only if the suffix is a valid json object
+	for fpos := bytes.Index(message, []byte("\t{")); fpos >= 0; {
+		if fields, err := serverLogParseFields(message[fpos+1:]); err == nil {
+			ldata.Message = string(message[:fpos])
+			ldata.Fields = fields
+			break
+		}
+
+		npos := bytes.Index(message[fpos+1:], []byte("\t{"))
+		if npos < 0 {
+			break
+		}
+		fpos += npos + 1
+	}
+
+	return ldata, nil
+}
+
+// Parses a json object of structured fields. Only scalar values are accepted.
+func serverLogParseFields(fdata []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(fdata, &fields); err != nil {
+		return nil, err
+	}
+	if err := serverLogValidateFields(fields); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	return fields, nil
+}
+
+func serverLogValidateFields(fields map[string]interface{}) error {
+	for fn, fv := range fields {
+		if !data.ValidateValueName(fn) {
+			return fmt.Errorf("invalid field name - name not validated: %s", fn)
+		}
+
+		switch fv.(type) {
+		case string, float64, bool, nil:
+		default:
+			return fmt.Errorf("invalid value for field %s - only scalar values are accepted", fn)
+		}
+	}
+	return nil
+}
+
+// {"app":"APP","level":LEVEL,"mid":"MESSAGEID","msg":"MESSAGE","ts":TIMESTAMP,...}
+// ts is optional, and can be unix seconds or a RFC3339 string.
+// Any other keys are saved as structured fields.
+func serverLogParseJSON(line []byte) (*data.LogData, error) {
+	var values map[string]interface{}
+	if err := json.Unmarshal(line, &values); err != nil {
+		return nil, fmt.Errorf("error parsing json log: %s", err)
+	}
+
+	ldata := &data.LogData{Date: time.Now()}
+
+	for vn, vv := range values {
+		switch vn {
+		case "app":
+			app, ok := vv.(string)
+			if !ok {
+				return nil, fmt.Errorf("error parsing json log: app must be a string")
+			}
+			ldata.App = app
+			delete(values, vn)
+		case "level":
+			level, ok := vv.(float64)
+			if !ok || level != float64(int(level)) {
+				return nil, fmt.Errorf("error parsing json log: level must be an integer")
+			}
+			ldata.Level = data.LogLevel(level)
+			delete(values, vn)
+		case "mid":
+			mid, ok := vv.(string)
+			if !ok {
+				return nil, fmt.Errorf("error parsing json log: mid must be a string")
+			}
+			ldata.MessageId = mid
+			delete(values, vn)
+		case "msg":
+			msg, ok := vv.(string)
+			if !ok {
+				return nil, fmt.Errorf("error parsing json log: msg must be a string")
+			}
+			ldata.Message = msg
+			delete(values, vn)
+		case "ts":
+			ts, err := serverLogParseJSONTimestamp(vv)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing json log: %s", err)
+			}
+			if err := validateTimestamp(ts); err != nil {
+				return nil, fmt.Errorf("error parsing json log: %s", err)
+			}
+			ldata.Date = ts
+			delete(values, vn)
+		}
+	}
+
+	if ldata.App == "" {
+		return nil, fmt.Errorf("error parsing json log: app is required")
+	}
+	if ldata.Level == 0 {
+		return nil, fmt.Errorf("error parsing json log: level is required")
+	}
+
+	// remaining values are structured fields
+	if err := serverLogValidateFields(values); err != nil {
+		return nil, fmt.Errorf("error parsing json log: %s", err)
+	}
+	if len(values) > 0 {
+		ldata.Fields = values
+	}
+
 	return ldata, nil
 }
+
+func serverLogParseJSONTimestamp(ts interface{}) (time.Time, error) {
+	switch v := ts.(type) {
+	case float64:
+		return checkedUnixSecondsToTime(v)
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid ts: %s", err)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("ts must be a number or a string")
+}
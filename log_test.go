@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RangelReale/appstatsd/data"
+	"testing"
+	"time"
+)
+
+func TestLogParseLine(t *testing.T) {
+	ldata, err := serverLogParseLine([]byte("app1:2:MSG1:An error: with colon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.App != "app1" || ldata.Level != data.ERROR || ldata.MessageId != "MSG1" || ldata.Message != "An error: with colon" {
+		t.Errorf("invalid parsed data: %+v", ldata)
+	}
+	if ldata.Fields != nil {
+		t.Errorf("fields should be nil: %+v", ldata.Fields)
+	}
+
+	if _, err := serverLogParseLine([]byte("app1:x:MSG1:An error")); err == nil {
+		t.Error("invalid level should return an error")
+	}
+}
+
+func TestLogParseLineFields(t *testing.T) {
+	ldata, err := serverLogParseLine([]byte("app1:3::Slow request\t{\"user\":\"john\",\"ms\":320}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.Message != "Slow request" {
+		t.Errorf("invalid message: %q", ldata.Message)
+	}
+	if ldata.Fields["user"] != "john" || ldata.Fields["ms"] != float64(320) {
+		t.Errorf("invalid fields: %+v", ldata.Fields)
+	}
+
+	// invalid json is kept in the message
+	ldata, err = serverLogParseLine([]byte("app1:3::Text\t{not json}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.Message != "Text\t{not json}" || ldata.Fields != nil {
+		t.Errorf("invalid parsed data: %+v", ldata)
+	}
+
+	// invalid field names are not accepted
+	ldata, err = serverLogParseLine([]byte("app1:3::Text\t{\"a.b\":1}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.Fields != nil {
+		t.Errorf("fields should be nil: %+v", ldata.Fields)
+	}
+}
+
+func TestLogParseLineTimestamp(t *testing.T) {
+	ts := time.Now().Add(-time.Minute).Unix()
+
+	ldata, err := serverLogParseLine([]byte(fmt.Sprintf("app1:2@%d.5:MSG1:An error", ts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.Level != data.ERROR || ldata.Date.Unix() != ts || ldata.Date.Nanosecond() != 500000000 {
+		t.Errorf("invalid parsed data: %+v", ldata)
+	}
+
+	// outside of allowed skew
+	ts = time.Now().Add(-time.Duration(Configuration.MaxTimestampSkew+60) * time.Second).Unix()
+	if _, err := serverLogParseLine([]byte(fmt.Sprintf("app1:2@%d:MSG1:An error", ts))); err == nil {
+		t.Error("timestamp outside of allowed skew should return an error")
+	}
+}
+
+func TestLogParseInvalidTimestamp(t *testing.T) {
+	defer func(maxskew int32) {
+		Configuration.MaxTimestampSkew = maxskew
+	}(Configuration.MaxTimestampSkew)
+	Configuration.MaxTimestampSkew = 0
+
+	for _, ts := range []string{"NaN", "Inf", "1e300", "-1"} {
+		if _, err := serverLogParseLine([]byte("app1:2@" + ts + ":MSG1:An error")); err == nil {
+			t.Errorf("timestamp %s should return an error", ts)
+		}
+	}
+	if _, err := serverLogParseJSONTimestamp(1e300); err == nil {
+		t.Error("json timestamp 1e300 should return an error")
+	}
+}
+
+func TestLogParseJSON(t *testing.T) {
+	ts := time.Now().Add(-time.Minute).Unix()
+
+	ldata, err := serverLogParseJSON([]byte(fmt.Sprintf(`{"app":"app1","level":2,"mid":"MSG1","msg":"An error","ts":%d.5,"user":"john"}`, ts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.App != "app1" || ldata.Level != data.ERROR || ldata.MessageId != "MSG1" || ldata.Message != "An error" {
+		t.Errorf("invalid parsed data: %+v", ldata)
+	}
+	if ldata.Date.Unix() != ts || ldata.Date.Nanosecond() != 500000000 {
+		t.Errorf("invalid date: %s", ldata.Date)
+	}
+	if len(ldata.Fields) != 1 || ldata.Fields["user"] != "john" {
+		t.Errorf("invalid fields: %+v", ldata.Fields)
+	}
+
+	tsstr := time.Unix(ts, 0).UTC().Format(time.RFC3339)
+	ldata, err = serverLogParseJSON([]byte(fmt.Sprintf(`{"app":"app1","level":5,"msg":"Info","ts":"%s"}`, tsstr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.Date.Unix() != ts || ldata.Fields != nil {
+		t.Errorf("invalid parsed data: %+v", ldata)
+	}
+
+	for _, line := range []string{
+		`{"level":2,"msg":"No app"}`,
+		`{"app":"app1","level":"2","msg":"String level"}`,
+		`{"app":"app1","level":2,"msg":"Nested","extra":{"a":1}}`,
+		`{"app":"app1","level":2,"msg":"Bad ts","ts":"yesterday"}`,
+		`{"app":"app1","level":2,"msg":"Old ts","ts":"2014-11-28T15:45:07Z"}`,
+	} {
+		if _, err := serverLogParseJSON([]byte(line)); err == nil {
+			t.Errorf("line should return an error: %s", line)
+		}
+	}
+}
+
+func TestLogHandleMessageFraming(t *testing.T) {
+	defer func(framing string, errstats bool) {
+		Configuration.LogFraming = framing
+		Configuration.ErrorStatistics = errstats
+	}(Configuration.LogFraming, Configuration.ErrorStatistics)
+	Configuration.ErrorStatistics = false
+
+	tests := []struct {
+		framing string
+		msg     string
+		logs    []string
+	}{
+		{"newline", "app1:5::first\r\napp1:5::second", []string{"first", "second"}},
+		{"octet", "24 app1:2::Error\n at line 1\n14 app1:5::second\n", []string{"Error\n at line 1", "second"}},
+	}
+
+	for _, tt := range tests {
+		Configuration.LogFraming = tt.framing
+		serverLogHandleMessage(nil, []byte(tt.msg), "")
+
+		for _, msg := range tt.logs {
+			select {
+			case dbmsg := <-DatabaseChan:
+				if dbmsg.log == nil || dbmsg.log.Message != msg {
+					t.Errorf("invalid log message for framing %s: %+v", tt.framing, dbmsg.log)
+				}
+			default:
+				t.Errorf("log message not sent for framing %s: %q", tt.framing, msg)
+			}
+		}
+	}
+}
+
+func TestLogErrorStatisticsBucket(t *testing.T) {
+	ldata := &data.LogData{App: "app1", Level: data.ERROR, MessageId: "E1001"}
+
+	rule := &ErrorStatisticsRule{Bucket: "error.ct"}
+	if b := serverLogErrorStatisticsBucket(rule, ldata); b != "app1.error.ct" {
+		t.Errorf("invalid bucket: %s", b)
+	}
+
+	rule.MessageId = true
+	if b := serverLogErrorStatisticsBucket(rule, ldata); b != "app1.error#E1001.ct" {
+		t.Errorf("invalid bucket: %s", b)
+	}
+
+	// message ids with separators are not used
+	ldata.MessageId = "E.1001"
+	if b := serverLogErrorStatisticsBucket(rule, ldata); b != "app1.error.ct" {
+		t.Errorf("invalid bucket: %s", b)
+	}
+}
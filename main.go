@@ -2,30 +2,226 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"github.com/RangelReale/appstatsd/confutil"
 	"github.com/op/go-logging"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var log = logging.MustGetLogger("appstatsd")
 
 var configfile = flag.String("configfile", "", "configuration file path")
 
+type command struct {
+	usage string
+	// registers the command flags, optional
+	flags func()
+	// runs the command with the remaining arguments
+	run func(args []string) error
+}
+
+var commands = map[string]*command{
+	"serve": {
+		usage: "run the statsd, log, syslog and info servers",
+		run:   cmdServe,
+	},
+	"ingest": {
+		usage: "run the statsd, log and syslog servers (default)",
+		run:   cmdIngest,
+	},
+	"info": {
+		usage: "run the info server",
+		run:   cmdInfo,
+	},
+	"query": {
+		usage: "query log messages or statistics: query log | query stats PROCESS",
+		flags: queryFlags,
+		run:   cmdQuery,
+	},
+	"export": {
+		usage: "export the log and statistics collections",
+		flags: exportFlags,
+		run:   cmdExport,
+	},
+	"import": {
+		usage: "import collections saved by export",
+		flags: importFlags,
+		run:   cmdImport,
+	},
+}
+
 func main() {
-	flag.Parse()
+	// appstatsd [COMMAND] [FLAGS] [ARGS]
+	cmdname := "ingest"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmdname = args[0]
+		args = args[1:]
+	}
 
-	// load configuration file
-	if *configfile != "" {
-		log.Debug("Loading configuration file %s", *configfile)
+	cmd, ok := commands[cmdname]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", cmdname)
+		usage()
+		os.Exit(2)
+	}
 
-		err := Configuration.Load(*configfile)
-		if err != nil {
-			log.Fatal(err.Error())
-		}
+	// configuration precedence: defaults, configuration file, environment variables, flags
+	if cmd.flags != nil {
+		cmd.flags()
+	}
+	confutil.AddFlags(flag.CommandLine, Configuration)
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+
+	if *configfile == "" {
+		*configfile = os.Getenv(confutil.EnvPrefix + "CONFIGFILE")
+	}
+
+	if err := loadConfiguration(Configuration); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := Configuration.Validate(); err != nil {
+		log.Fatal(err.Error())
+	}
+	setLoggingLevel(Configuration.LoggingLevel)
+
+	if err := cmd.run(flag.Args()); err != nil {
+		log.Error("%s", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [COMMAND] [FLAGS] [ARGS]\n\nCommands:\n", os.Args[0])
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].usage)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// Runs the ingest and info servers in the same process
+func cmdServe(args []string) error {
+	startIngest()
+	server := startInfo()
+
+	sig := waitSignal()
+	log.Notice("Received %s, shutting down", sig)
+
+	// info first, it uses the database session closed by the ingest shutdown
+	timeout := time.Duration(Configuration.ShutdownTimeout) * time.Second
+	start := time.Now()
+	if err := ShutdownInfo(server, timeout); err != nil {
+		return fmt.Errorf("Error shutting down: %s", err)
+	}
+	if err := Shutdown(timeout - time.Since(start)); err != nil {
+		return fmt.Errorf("Error shutting down: %s", err)
+	}
+	log.Notice("Shutdown complete")
+	return nil
+}
+
+func cmdIngest(args []string) error {
+	startIngest()
+
+	sig := waitSignal()
+	log.Notice("Received %s, shutting down", sig)
+
+	if err := Shutdown(time.Duration(Configuration.ShutdownTimeout) * time.Second); err != nil {
+		return fmt.Errorf("Error shutting down: %s", err)
 	}
+	log.Notice("Shutdown complete")
+	return nil
+}
+
+func cmdInfo(args []string) error {
+	go ServerReload()
+
+	server := startInfo()
+
+	sig := waitSignal()
+	log.Notice("Received %s, shutting down", sig)
+
+	err := ShutdownInfo(server, time.Duration(Configuration.ShutdownTimeout)*time.Second)
+	dbClose()
+	if err != nil {
+		return fmt.Errorf("Error shutting down: %s", err)
+	}
+	log.Notice("Shutdown complete")
+	return nil
+}
+
+func startIngest() {
+	var err error
+	ingestFilter, err = NewIngestFilter(Configuration)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	graphite = NewGraphiteForwarder(Configuration)
+
+	go ServerReload()
 
 	go ServerDatabase()
+	go ServerSystem()
+	go ServerGraphite()
 
 	go ServerLog()
+	go ServerSyslog()
 	go ServerStatsd()
+}
+
+func startInfo() *http.Server {
+	infoLoadFonts()
+
+	server := NewInfoServer()
+	go ServerInfo(server)
+	return server
+}
+
+// Waits for SIGTERM or SIGINT
+func waitSignal() os.Signal {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGTERM, os.Interrupt)
+	return <-sigc
+}
+
+// Loads the configuration file, environment variables and flags into c
+func loadConfiguration(c *Config) error {
+	if *configfile != "" {
+		log.Debug("Loading configuration file %s", *configfile)
+
+		if err := c.Load(*configfile); err != nil {
+			return err
+		}
+	}
+
+	if err := confutil.ApplyEnv(c, confutil.EnvPrefix); err != nil {
+		return err
+	}
+	if err := confutil.ApplyFlags(flag.CommandLine, c); err != nil {
+		return err
+	}
+	c.SetDefaults()
+	return nil
+}
 
-	select {}
+// Sets the level of the process log, the level must have been validated
+func setLoggingLevel(name string) {
+	level, _ := logging.LogLevel(name)
+	logging.SetLevel(level, "appstatsd")
 }
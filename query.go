@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/RangelReale/appstatsd/data"
+	"github.com/RangelReale/appstatsd/info"
+	"os"
+)
+
+var queryOpts struct {
+	amount *int
+	app    *string
+	level  *int
+	mid    *string
+	data   *string
+	period *string
+	group  *string
+}
+
+func queryFlags() {
+	queryOpts.amount = flag.Int("amount", 0, "log: maximum number of records, default 100. stats: number of days, default 2")
+	queryOpts.app = flag.String("app", "", "only this app. stats: @ to use the per-app statistics of all apps")
+	queryOpts.level = flag.Int("level", 0, "log: only this level or more severe")
+	queryOpts.mid = flag.String("mid", "", "log: only this message id")
+	queryOpts.data = flag.String("data", "", "stats: comma-separated field names, with type prefix")
+	queryOpts.period = flag.String("period", "day", "stats: day, hour or minute")
+	queryOpts.group = flag.String("group", "", "stats: comma-separated fields to group by")
+}
+
+// Queries log messages or statistics, printing the same json data of the info server
+func cmdQuery(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("Query type required: log or stats")
+	}
+
+	session, err := DBConnectClone()
+	if err != nil {
+		return fmt.Errorf("Error connecting to database: %s", err)
+	}
+	defer session.Close()
+	db := session.DB(Configuration.MGODBName)
+
+	var result interface{}
+	switch args[0] {
+	case "log":
+		amount := *queryOpts.amount
+		if amount == 0 {
+			amount = 100
+		}
+		result, err = info.QueryLog(db, &info.LogQuery{
+			Amount:    amount,
+			App:       *queryOpts.app,
+			Level:     data.LogLevel(*queryOpts.level),
+			MessageId: *queryOpts.mid,
+		})
+	case "stats":
+		if len(args) < 2 {
+			return fmt.Errorf("Process required: query stats PROCESS")
+		}
+		amount := *queryOpts.amount
+		if amount == 0 {
+			amount = 2
+		}
+		var res *info.StatsQueryResult
+		res, err = info.QueryStats(db, &info.StatsQuery{
+			Process: args[1],
+			Data:    info.SplitParams(*queryOpts.data),
+			Period:  *queryOpts.period,
+			Filters: make(map[string]string),
+			Groups:  info.SplitParams(*queryOpts.group),
+			Amount:  amount,
+			App:     *queryOpts.app,
+		})
+		if err == nil {
+			result = res.Result
+		}
+	default:
+		return fmt.Errorf("Invalid query type: %s", args[0])
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading data: %s", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// kinds of rate limits
+const (
+	RateLimitMetrics = "metrics"
+	RateLimitLogs    = "logs"
+)
+
+// idle token buckets are removed after this time
+const rateLimitPurgeInterval = 10 * time.Minute
+
+// maximum distinct apps per day on the throttle counter, others are counted as __other__
+const rateLimitMaxCountedApps = 100
+
+type rateLimitBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Per-app token bucket rate limiter. Limits are read from the configuration
+// on each call. The bucket size is one second of traffic.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastpurge time.Time
+
+	// apps counted on the throttle counter on countedday
+	counted    map[string]bool
+	countedday string
+}
+
+var rateLimiter = NewRateLimiter()
+
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets:   make(map[string]*rateLimitBucket),
+		lastpurge: time.Now(),
+		counted:   make(map[string]bool),
+	}
+}
+
+// Returns the limit per second of kind for app, 0 for no limit
+func rateLimitFor(app string, kind string) float64 {
+	configMu.RLock()
+	defer configMu.RUnlock()
+
+	var limit float64
+	switch kind {
+	case RateLimitMetrics:
+		limit = Configuration.RateLimitMetrics
+	case RateLimitLogs:
+		limit = Configuration.RateLimitLogs
+	}
+
+	// per-app override. 0 uses the default, negative is no limit
+	if applimit, ok := Configuration.RateLimitApps[app]; ok {
+		var l float64
+		switch kind {
+		case RateLimitMetrics:
+			l = applimit.Metrics
+		case RateLimitLogs:
+			l = applimit.Logs
+		}
+		if l < 0 {
+			return 0
+		} else if l > 0 {
+			limit = l
+		}
+	}
+	return limit
+}
+
+// Checks if an item of kind from app is allowed. If not, counts the drop on
+// the _system.throttle#APP.KIND internal counter, limited to rateLimitMaxCountedApps
+// distinct apps per day.
+func (r *RateLimiter) Allow(app string, kind string) bool {
+	limit := rateLimitFor(app, kind)
+	if limit <= 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	allowed := r.take(kind+":"+app, limit)
+	var param string
+	if !allowed {
+		param = r.countedParam(app)
+	}
+	r.mu.Unlock()
+
+	if !allowed {
+		SystemCount("_system.throttle#"+param+"."+kind, 1)
+	}
+	return allowed
+}
+
+// Returns the throttle counter parameter of app, __other__ if the limit of apps of the day was reached
+func (r *RateLimiter) countedParam(app string) string {
+	day := time.Now().UTC().Format("2006-01-02")
+	if day != r.countedday {
+		r.counted = make(map[string]bool)
+		r.countedday = day
+	}
+
+	if !r.counted[app] {
+		if len(r.counted) >= rateLimitMaxCountedApps {
+			return "__other__"
+		}
+		r.counted[app] = true
+	}
+	return SystemParam(app)
+}
+
+func (r *RateLimiter) take(key string, limit float64) bool {
+	now := time.Now()
+
+	if now.Sub(r.lastpurge) >= rateLimitPurgeInterval {
+		for k, b := range r.buckets {
+			if now.Sub(b.last) >= rateLimitPurgeInterval {
+				delete(r.buckets, k)
+			}
+		}
+		r.lastpurge = now
+	}
+
+	// burst is one second of traffic, at least 1
+	burst := limit
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := r.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{tokens: burst, last: now}
+		r.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	defer func(metrics float64, apps map[string]RateLimitApp) {
+		Configuration.RateLimitMetrics = metrics
+		Configuration.RateLimitApps = apps
+	}(Configuration.RateLimitMetrics, Configuration.RateLimitApps)
+
+	Configuration.RateLimitMetrics = 5
+	Configuration.RateLimitApps = map[string]RateLimitApp{
+		"big":       {Metrics: 10},
+		"unlimited": {Metrics: -1},
+	}
+
+	r := NewRateLimiter()
+
+	tests := []struct {
+		app     string
+		allowed int
+	}{
+		{"app1", 5},
+		{"big", 10},
+		{"unlimited", 20},
+	}
+
+	for _, tt := range tests {
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if r.Allow(tt.app, RateLimitMetrics) {
+				allowed++
+			}
+		}
+		if allowed != tt.allowed {
+			t.Errorf("app %s should have %d allowed, got %d", tt.app, tt.allowed, allowed)
+		}
+	}
+
+	// logs have no limit
+	for i := 0; i < 20; i++ {
+		if !r.Allow("app1", RateLimitLogs) {
+			t.Fatal("logs should not be limited")
+		}
+	}
+
+	// drops are counted
+	systemCountersMu.Lock()
+	dropped := systemCounters["_system.throttle#app1.metrics"]
+	systemCountersMu.Unlock()
+	if dropped != 15 {
+		t.Errorf("app1 should have 15 dropped, got %f", dropped)
+	}
+}
+
+func TestRateLimiterCountedApps(t *testing.T) {
+	r := NewRateLimiter()
+	for i := 0; i < rateLimitMaxCountedApps; i++ {
+		if p := r.countedParam(fmt.Sprintf("app%d", i)); p != fmt.Sprintf("app%d", i) {
+			t.Fatalf("expected app%d, got %s", i, p)
+		}
+	}
+	if p := r.countedParam("newapp"); p != "__other__" {
+		t.Errorf("apps over the limit should be counted as __other__, got %s", p)
+	}
+	if p := r.countedParam("app1"); p != "app1" {
+		t.Errorf("apps already counted should keep their name, got %s", p)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Reloads the configuration on SIGHUP
+func ServerReload() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		log.Notice("Reloading configuration")
+		if err := ReloadConfig(); err != nil {
+			log.Error("Error reloading configuration, keeping the current one: %s", err)
+		}
+	}
+}
+
+// Loads and validates the configuration again, and applies the settings that can be changed
+// without restarting the listeners: logging level, rate limits, allow and deny lists,
+// error statistics rules, parameter cardinality limits, log deduplication window,
+// timestamp skew, packet signing keys, and the info server authentication and prometheus rules.
+// Other settings are only applied on restart. There is no data retention setting to reload.
+func ReloadConfig() error {
+	nc := NewConfig()
+	if err := loadConfiguration(nc); err != nil {
+		return err
+	}
+	if err := nc.Validate(); err != nil {
+		return err
+	}
+	filter, err := NewIngestFilter(nc)
+	if err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	Configuration.LoggingLevel = nc.LoggingLevel
+	Configuration.RateLimitMetrics = nc.RateLimitMetrics
+	Configuration.RateLimitLogs = nc.RateLimitLogs
+	Configuration.RateLimitApps = nc.RateLimitApps
+	Configuration.AllowApps = nc.AllowApps
+	Configuration.DenyApps = nc.DenyApps
+	Configuration.AllowInfos = nc.AllowInfos
+	Configuration.DenyInfos = nc.DenyInfos
+	Configuration.AllowFields = nc.AllowFields
+	Configuration.DenyFields = nc.DenyFields
+	Configuration.ErrorStatistics = nc.ErrorStatistics
+	Configuration.ErrorStatisticsRules = nc.ErrorStatisticsRules
+	Configuration.ParamCardinalityLimit = nc.ParamCardinalityLimit
+	Configuration.ParamCardinalityLimits = nc.ParamCardinalityLimits
+	Configuration.LogDedupWindow = nc.LogDedupWindow
+	Configuration.MaxTimestampSkew = nc.MaxTimestampSkew
+	Configuration.AuthRequired = nc.AuthRequired
+	Configuration.AuthKeys = nc.AuthKeys
+	Configuration.AuthTokens = nc.AuthTokens
+	Configuration.AuthUsers = nc.AuthUsers
+	Configuration.AuthProxyHeader = nc.AuthProxyHeader
+	Configuration.AuthProxyAddrs = nc.AuthProxyAddrs
+	Configuration.PrometheusRules = nc.PrometheusRules
+	ingestFilter = filter
+	configMu.Unlock()
+
+	setLoggingLevel(nc.LoggingLevel)
+
+	log.Notice("Configuration reloaded")
+	return nil
+}
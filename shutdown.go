@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// closed when shutdown starts
+	shutdownChan = make(chan struct{})
+
+	shutdownMu      sync.Mutex
+	shutdownStarted bool
+	shutdownClosers []io.Closer
+)
+
+// Registers a listener to be closed on shutdown. If shutdown already started, it is closed immediately.
+func shutdownRegister(c io.Closer) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+
+	if shutdownStarted {
+		c.Close()
+		return
+	}
+	shutdownClosers = append(shutdownClosers, c)
+}
+
+// Stops the listeners, waits for the received data to be handled, forwards the pending
+// metrics to graphite, and saves the internal counters and all queued messages to the
+// database before closing it.
+// Returns an error if not finished before timeout.
+func Shutdown(timeout time.Duration) error {
+	deadline := time.After(timeout)
+
+	shutdownMu.Lock()
+	if shutdownStarted {
+		shutdownMu.Unlock()
+		return fmt.Errorf("shutdown already started")
+	}
+	shutdownStarted = true
+	closers := shutdownClosers
+	shutdownClosers = nil
+	shutdownMu.Unlock()
+
+	close(shutdownChan)
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			log.Error("Error closing listener: %s", err)
+		}
+	}
+
+	// handlers of data already received
+	handlersdone := make(chan struct{})
+	go func() {
+		listenerHandlers.Wait()
+		close(handlersdone)
+	}()
+	select {
+	case <-handlersdone:
+	case <-deadline:
+		return fmt.Errorf("timeout waiting for the listeners to finish")
+	}
+
+	// internal counters, after the periodic flush stopped
+	select {
+	case <-systemStopped:
+	case <-deadline:
+		return fmt.Errorf("timeout waiting for the internal counters")
+	}
+	systemFlush()
+
+	// metrics not yet forwarded, after the periodic flush stopped
+	if graphite != nil {
+		select {
+		case <-graphiteStopped:
+		case <-deadline:
+			return fmt.Errorf("timeout waiting for the graphite forwarder")
+		}
+		flushed := make(chan struct{})
+		go func() {
+			graphite.Flush()
+			close(flushed)
+		}()
+		select {
+		case <-flushed:
+		case <-deadline:
+			return fmt.Errorf("timeout sending metrics to graphite")
+		}
+	}
+
+	// queued messages
+	close(dbStop)
+	select {
+	case <-dbStopped:
+	case <-deadline:
+		return fmt.Errorf("timeout saving queued messages, %d not saved", len(DatabaseChan))
+	}
+	return nil
+}
@@ -1,15 +1,198 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/RangelReale/gostatsd/statsd"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Receive statsd metrics via udp, and optionally tcp
 func ServerStatsd() {
-	f := func(m statsd.Metric) {
-		//log.Debug("Metric received: %s: %s [%f]", m.Type.String(), m.Bucket, m.Value)
-		DatabaseChan <- DBMessage{metrics: &m}
+	if Configuration.StatsdTCPPort != 0 {
+		go serverStatsdTCP()
 	}
-	r := statsd.MetricReceiver{fmt.Sprintf("%s:%d", Configuration.ListenHost, Configuration.StatsdPort), statsd.HandlerFunc(f)}
-	r.ListenAndReceive()
+
+	c, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", Configuration.ListenHost, Configuration.StatsdPort))
+	if err != nil {
+		log.Fatal("Error creating statsd server: %s", err.Error())
+	}
+
+	defer c.Close()
+
+	ReceivePackets("statsd", c, 1024, func(addr net.Addr, msg []byte) {
+		if payload, authapp, ok := PacketAuth("statsd", addr, msg); ok {
+			serverStatsdHandleMessage(addr, payload, authapp)
+		}
+	})
+}
+
+// Receive newline-delimited statsd metrics via tcp
+func serverStatsdTCP() {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", Configuration.ListenHost, Configuration.StatsdTCPPort))
+	if err != nil {
+		log.Fatal("Error creating statsd tcp server: %s", err.Error())
+	}
+
+	ss := &StreamServer{
+		Name:           "statsd_tcp",
+		Listener:       l,
+		MaxMessageSize: 1024,
+		Handler: func(addr net.Addr, line []byte) {
+			serverStatsdHandleLine(addr, line, "")
+		},
+		MaxConnections: int(Configuration.StatsdTCPMaxConnections),
+		IdleTimeout:    time.Duration(Configuration.StatsdTCPIdleTimeout) * time.Second,
+	}
+	if err := ss.Serve(); err != nil {
+		log.Error("Error on statsd tcp server: %s", err)
+	}
+}
+
+// Handles a datagram, which can contain multiple lines.
+// If authapp is not blank, only metrics of this app are accepted.
+func serverStatsdHandleMessage(addr net.Addr, msg []byte, authapp string) {
+	buf := bytes.NewBuffer(msg)
+	for {
+		line, readerr := buf.ReadBytes('\n')
+
+		// don't require line to end in \n, if EOF use received line if valid
+		if readerr != nil && readerr != io.EOF {
+			log.Error("error reading message from %s: %s", addr, readerr)
+			return
+		} else if readerr != io.EOF {
+			// remove newline, only if not EOF
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+			}
+		}
+
+		serverStatsdHandleLine(addr, line, authapp)
+
+		if readerr != nil && readerr == io.EOF {
+			// if was EOF, finished handling
+			return
+		}
+	}
+}
+
+// Handles a single metric line
+func serverStatsdHandleLine(addr net.Addr, line []byte, authapp string) {
+	// Only process lines with more than one character
+	if len(line) <= 1 {
+		return
+	}
+
+	m, tm, err := serverStatsdParseLine(line)
+	if err != nil {
+		log.Error("error parsing line %q from %s: %s", line, addr, err)
+		SystemCount(fmt.Sprintf(systemParseErrors, "statsd"), 1)
+		return
+	}
+
+	if !packetAuthAllowApp("statsd", addr, authapp, metricApp(m.Bucket)) {
+		return
+	}
+	configMu.RLock()
+	filter := ingestFilter
+	configMu.RUnlock()
+
+	if !filter.AllowMetric(m.Bucket) {
+		return
+	}
+	if !rateLimiter.Allow(metricApp(m.Bucket), RateLimitMetrics) {
+		return
+	}
+
+	//log.Debug("Metric received: %s: %s [%f]", m.Type.String(), m.Bucket, m.Value)
+	DatabaseChan <- DBMessage{metrics: m, date: tm}
+
+	if graphite != nil {
+		graphite.Add(m, tm)
+	}
+}
+
+// BUCKET:VALUE|TYPE[|@SAMPLERATE][|TTIMESTAMP]
+// TIMESTAMP is optional unix seconds, if not sent the current time is used.
+func serverStatsdParseLine(line []byte) (*statsd.Metric, time.Time, error) {
+	metric := &statsd.Metric{}
+	tm := time.Now()
+
+	fields := bytes.Split(line, []byte("|"))
+	if len(fields) < 2 {
+		return nil, tm, fmt.Errorf("error parsing metric: type not found")
+	}
+
+	bucketvalue := fields[0]
+	vpos := bytes.LastIndex(bucketvalue, []byte(":"))
+	if vpos < 0 {
+		return nil, tm, fmt.Errorf("error parsing metric name: value not found")
+	}
+	metric.Bucket = string(bucketvalue[:vpos])
+
+	value, err := strconv.ParseFloat(string(bucketvalue[vpos+1:]), 64)
+	if err != nil {
+		return nil, tm, fmt.Errorf("error converting metric value: %s", err)
+	}
+
+	metric.Value = value
+
+	switch string(fields[1]) {
+	case "ms":
+		metric.Type = statsd.TIMER
+	case "g":
+		metric.Type = statsd.GAUGE
+	case "c":
+		metric.Type = statsd.COUNTER
+	default:
+		return nil, tm, fmt.Errorf("invalid metric type: %q", fields[1])
+	}
+
+	for _, ext := range fields[2:] {
+		if len(ext) == 0 {
+			return nil, tm, fmt.Errorf("error parsing metric: blank field")
+		}
+
+		switch ext[0] {
+		case '@':
+			rate, err := strconv.ParseFloat(string(ext[1:]), 64)
+			if err != nil || !(rate > 0 && rate <= 1) {
+				return nil, tm, fmt.Errorf("invalid sample rate: %q", ext[1:])
+			}
+			// only counters are scaled, timers and gauges are averaged
+			if metric.Type == statsd.COUNTER {
+				metric.Value = metric.Value / rate
+			}
+		case 'T':
+			tm, err = parseUnixTimestamp(string(ext[1:]))
+			if err != nil {
+				return nil, tm, fmt.Errorf("error parsing metric: %s", err)
+			}
+			if err := validateTimestamp(tm); err != nil {
+				return nil, tm, fmt.Errorf("error parsing metric: %s", err)
+			}
+		default:
+			return nil, tm, fmt.Errorf("invalid metric field: %q", ext)
+		}
+	}
+
+	// would be saved with $inc, making the totals invalid
+	if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+		return nil, tm, fmt.Errorf("invalid metric value: %q", bucketvalue[vpos+1:])
+	}
+
+	return metric, tm, nil
+}
+
+// Returns the app of a bucket, the first dot-separated item
+func metricApp(bucket string) string {
+	if apos := strings.IndexByte(bucket, '.'); apos >= 0 {
+		return bucket[:apos]
+	}
+	return bucket
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"github.com/RangelReale/gostatsd/statsd"
+	"testing"
+	"time"
+)
+
+func TestStatsdParseLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		mtype  statsd.MetricType
+		bucket string
+		value  float64
+	}{
+		{"app.conn.ct:1|c", statsd.COUNTER, "app.conn.ct", 1},
+		{"app.conn#proj.dr:320|ms", statsd.TIMER, "app.conn#proj.dr", 320},
+		{"app.mem.used:12.5|g", statsd.GAUGE, "app.mem.used", 12.5},
+		{"app.conn.ct:1|c|@0.1", statsd.COUNTER, "app.conn.ct", 10},
+		{"app.conn.dr:320|ms|@0.5", statsd.TIMER, "app.conn.dr", 320},
+	}
+
+	for _, tt := range tests {
+		m, _, err := serverStatsdParseLine([]byte(tt.line))
+		if err != nil {
+			t.Errorf("error parsing %q: %s", tt.line, err)
+			continue
+		}
+		if m.Type != tt.mtype || m.Bucket != tt.bucket || m.Value != tt.value {
+			t.Errorf("invalid metric for %q: %+v", tt.line, m)
+		}
+	}
+
+	for _, line := range []string{"app.conn.ct", "app.conn.ct:1", "app.conn.ct:x|c", "app.conn.ct:1|x", "app.conn.ct:1|c|@2", "app.conn.ct:1|c|x"} {
+		if _, _, err := serverStatsdParseLine([]byte(line)); err == nil {
+			t.Errorf("line should return an error: %q", line)
+		}
+	}
+}
+
+func TestStatsdParseLineTimestamp(t *testing.T) {
+	ts := time.Now().Add(-time.Minute).Unix()
+
+	_, tm, err := serverStatsdParseLine([]byte(fmt.Sprintf("app.conn.ct:1|c|T%d", ts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.Unix() != ts {
+		t.Errorf("invalid timestamp: %s", tm)
+	}
+
+	ts = time.Now().Add(time.Duration(Configuration.MaxTimestampSkew+60) * time.Second).Unix()
+	if _, _, err := serverStatsdParseLine([]byte(fmt.Sprintf("app.conn.ct:1|c|T%d", ts))); err == nil {
+		t.Error("timestamp outside of allowed skew should return an error")
+	}
+}
+
+func TestStatsdParseLineInvalidNumbers(t *testing.T) {
+	defer func(maxskew int32) {
+		Configuration.MaxTimestampSkew = maxskew
+	}(Configuration.MaxTimestampSkew)
+	Configuration.MaxTimestampSkew = 0
+
+	for _, line := range []string{
+		"app.conn.ct:NaN|c",
+		"app.conn.ct:Inf|c",
+		"app.conn.ct:-Inf|g",
+		"app.conn.ct:1e308|c|@0.01",
+		"app.conn.ct:1|c|@NaN",
+		"app.conn.ct:1|c|TNaN",
+		"app.conn.ct:1|c|TInf",
+		"app.conn.ct:1|c|T1e300",
+		"app.conn.ct:1|c|T-1",
+	} {
+		if _, _, err := serverStatsdParseLine([]byte(line)); err == nil {
+			t.Errorf("%s should return an error", line)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/RangelReale/appstatsd/data"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Receive syslog messages via udp and tcp
+func ServerSyslog() {
+	if Configuration.SyslogPort == 0 {
+		return
+	}
+
+	addr := fmt.Sprintf("%s:%d", Configuration.ListenHost, Configuration.SyslogPort)
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("Error creating syslog tcp server: %s", err.Error())
+	}
+	ss := &StreamServer{
+		Name:           "syslog_tcp",
+		Listener:       l,
+		MaxMessageSize: int(Configuration.LogMaxMessageSize),
+		Split:          syslogSplit,
+		Handler:        serverSyslogHandleMessage,
+	}
+	go func() {
+		if err := ss.Serve(); err != nil {
+			log.Error("Error on syslog tcp server: %s", err)
+		}
+	}()
+
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Fatal("Error creating syslog udp server: %s", err.Error())
+	}
+
+	defer c.Close()
+
+	// one message per datagram
+	ReceivePackets("syslog", c, int(Configuration.LogMaxMessageSize), serverSyslogHandleMessage)
+}
+
+func serverSyslogHandleMessage(addr net.Addr, msg []byte) {
+	msg = bytes.TrimRight(msg, "\r\n\x00")
+	if len(msg) == 0 {
+		return
+	}
+
+	ldata, err := serverSyslogParse(msg)
+	if err != nil {
+		log.Error("error parsing syslog message %q from %s: %s", msg, addr, err)
+		SystemCount(fmt.Sprintf(systemParseErrors, "syslog"), 1)
+		return
+	}
+
+	serverLogDispatch(ldata)
+}
+
+// Splits tcp syslog messages, either octet-counted or newline-delimited (RFC 6587)
+func syslogSplit(buf []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(buf) > 0 && buf[0] >= '0' && buf[0] <= '9' {
+		// octet counting: MSG-LEN SP SYSLOG-MSG
+		return ScanOctetCounted(buf, atEOF)
+	}
+
+	// non-transparent framing
+	advance, token, err = bufio.ScanLines(buf, atEOF)
+	if err == nil && token != nil && len(token) == 0 {
+		// skip blank lines
+		return advance, nil, nil
+	}
+	return
+}
+
+// Maps syslog severity to log level
+func syslogSeverityLevel(severity int) data.LogLevel {
+	switch severity {
+	case 0, 1, 2: // emergency, alert, critical
+		return data.CRITICAL
+	case 3:
+		return data.ERROR
+	case 4:
+		return data.WARNING
+	case 5:
+		return data.NOTICE
+	case 6:
+		return data.INFO
+	}
+	return data.DEBUG
+}
+
+// Parses RFC 5424 or RFC 3164 syslog messages
+// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+func serverSyslogParse(msg []byte) (*data.LogData, error) {
+	if len(msg) < 3 || msg[0] != '<' {
+		return nil, fmt.Errorf("error parsing syslog: priority not found")
+	}
+	pend := bytes.IndexByte(msg, '>')
+	if pend < 2 || pend > 4 {
+		return nil, fmt.Errorf("error parsing syslog: invalid priority")
+	}
+	pri, err := strconv.Atoi(string(msg[1:pend]))
+	if err != nil || pri > 191 {
+		return nil, fmt.Errorf("error parsing syslog: invalid priority")
+	}
+
+	ldata := &data.LogData{Date: time.Now(), Level: syslogSeverityLevel(pri & 7)}
+
+	msg = msg[pend+1:]
+	if bytes.HasPrefix(msg, []byte("1 ")) {
+		err = serverSyslogParse5424(ldata, msg[2:])
+	} else {
+		err = serverSyslogParse3164(ldata, msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ldata.App = syslogAppName(ldata.App)
+	return ldata, nil
+}
+
+// Removes the characters not allowed in app names, like in systemd-journald or postfix/smtpd,
+// so the error statistics buckets are valid. Apps without any valid character are saved as "syslog".
+func syslogAppName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, name)
+	if name == "" {
+		return "syslog"
+	}
+	return name
+}
+
+func serverSyslogParse5424(ldata *data.LogData, msg []byte) error {
+	// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID
+	header := make([]string, 5)
+	for i := range header {
+		sp := bytes.IndexByte(msg, ' ')
+		if sp < 0 {
+			return fmt.Errorf("error parsing syslog: incomplete header")
+		}
+		header[i] = string(msg[:sp])
+		msg = msg[sp+1:]
+	}
+
+	if header[0] != "-" {
+		tm, err := time.Parse(time.RFC3339Nano, header[0])
+		if err != nil {
+			return fmt.Errorf("error parsing syslog: invalid timestamp: %s", err)
+		}
+		if err := validateTimestamp(tm); err != nil {
+			return fmt.Errorf("error parsing syslog: %s", err)
+		}
+		ldata.Date = tm
+	}
+	if header[2] != "-" {
+		ldata.App = header[2]
+	}
+	if header[4] != "-" {
+		ldata.MessageId = header[4]
+	}
+
+	// STRUCTURED-DATA is not used, only skipped
+	if len(msg) > 0 && msg[0] == '-' {
+		msg = msg[1:]
+	} else {
+		for len(msg) > 0 && msg[0] == '[' {
+			end := syslogSDElementEnd(msg)
+			if end < 0 {
+				return fmt.Errorf("error parsing syslog: invalid structured data")
+			}
+			msg = msg[end+1:]
+		}
+	}
+
+	if len(msg) > 0 && msg[0] == ' ' {
+		msg = msg[1:]
+	}
+	ldata.Message = string(bytes.TrimPrefix(msg, []byte("\xef\xbb\xbf")))
+
+	return nil
+}
+
+// Returns the position of the "]" that ends the structured data element at the start of msg
+func syslogSDElementEnd(msg []byte) int {
+	inquote := false
+	for i := 1; i < len(msg); i++ {
+		switch msg[i] {
+		case '\\':
+			// escaped character
+			i++
+		case '"':
+			inquote = !inquote
+		case ']':
+			if !inquote {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// The RFC 3164 timestamp has no year nor timezone, so the current time is used
+func serverSyslogParse3164(ldata *data.LogData, msg []byte) error {
+	// TIMESTAMP HOSTNAME, both optional
+	if len(msg) >= len(time.Stamp)+1 && msg[len(time.Stamp)] == ' ' {
+		if _, err := time.Parse(time.Stamp, string(msg[:len(time.Stamp)])); err == nil {
+			msg = msg[len(time.Stamp)+1:]
+
+			// hostname
+			if sp := bytes.IndexByte(msg, ' '); sp >= 0 && bytes.IndexByte(msg[:sp], ':') < 0 {
+				msg = msg[sp+1:]
+			}
+		}
+	}
+
+	// TAG[PID]: MSG
+	tagend := bytes.IndexAny(msg, "[: ")
+	if tagend > 0 {
+		ldata.App = string(msg[:tagend])
+		msg = msg[tagend:]
+		if msg[0] == '[' {
+			if pend := bytes.IndexByte(msg, ']'); pend >= 0 {
+				msg = msg[pend+1:]
+			}
+		}
+		msg = bytes.TrimPrefix(msg, []byte(":"))
+		msg = bytes.TrimPrefix(msg, []byte(" "))
+	}
+	ldata.Message = string(msg)
+
+	return nil
+}
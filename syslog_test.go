@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"github.com/RangelReale/appstatsd/data"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogParse5424(t *testing.T) {
+	ts := time.Now().Add(-time.Minute).UTC().Truncate(time.Millisecond)
+
+	ldata, err := serverSyslogParse([]byte("<165>1 " + ts.Format(time.RFC3339Nano) +
+		" host1 nginx 1234 ID47 [exampleSDID@32473 iut=\"3\" eventSource=\"Ap]p\"] \xef\xbb\xbfAn application event"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.App != "nginx" || ldata.Level != data.NOTICE || ldata.MessageId != "ID47" || ldata.Message != "An application event" {
+		t.Errorf("invalid parsed data: %+v", ldata)
+	}
+	if !ldata.Date.Equal(ts) {
+		t.Errorf("invalid date: %s", ldata.Date)
+	}
+
+	ldata, err = serverSyslogParse([]byte("<11>1 - host1 app1 - - - Failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.App != "app1" || ldata.Level != data.ERROR || ldata.MessageId != "" || ldata.Message != "Failed" {
+		t.Errorf("invalid parsed data: %+v", ldata)
+	}
+
+	// app names are cleaned, so the error statistics buckets are valid
+	ldata, err = serverSyslogParse([]byte("<11>1 - host1 systemd-journald - - - Failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.App != "systemdjournald" || !data.ValidateName(ldata.App) {
+		t.Errorf("invalid app: %q", ldata.App)
+	}
+
+	ldata, err = serverSyslogParse([]byte("<11>1 - host1 - - - - Failed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ldata.App != "syslog" {
+		t.Errorf("messages without app should use syslog, got %q", ldata.App)
+	}
+}
+
+func TestSyslogParse3164(t *testing.T) {
+	tests := []struct {
+		msg   string
+		app   string
+		level data.LogLevel
+		text  string
+	}{
+		{"<34>Oct 11 22:14:15 mymachine su: 'su root' failed", "su", data.CRITICAL, "'su root' failed"},
+		{"<28>Oct  1 02:04:05 host1 nginx[1234]: upstream timed out", "nginx", data.WARNING, "upstream timed out"},
+		{"<30>cron[99]: job started", "cron", data.INFO, "job started"},
+		{"<22>Oct 11 22:14:15 mail1 postfix/smtpd[1234]: connect from unknown", "postfixsmtpd", data.INFO, "connect from unknown"},
+		{"<30>systemd-journald[1]: Journal started", "systemdjournald", data.INFO, "Journal started"},
+		{"<30>: no tag", "syslog", data.INFO, ": no tag"},
+	}
+
+	for _, tt := range tests {
+		ldata, err := serverSyslogParse([]byte(tt.msg))
+		if err != nil {
+			t.Errorf("error parsing %q: %s", tt.msg, err)
+			continue
+		}
+		if ldata.App != tt.app || ldata.Level != tt.level || ldata.Message != tt.text {
+			t.Errorf("invalid parsed data for %q: %+v", tt.msg, ldata)
+		}
+	}
+
+	for _, msg := range []string{"no priority", "<>1 - - - - - -", "<999>test"} {
+		if _, err := serverSyslogParse([]byte(msg)); err == nil {
+			t.Errorf("message should return an error: %q", msg)
+		}
+	}
+}
+
+func TestSyslogSplit(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("10 <13>first\n\n<13>second\n10 <13>th\nird"))
+	scanner.Split(syslogSplit)
+
+	var msgs []string
+	for scanner.Scan() {
+		msgs = append(msgs, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 3 || msgs[0] != "<13>first\n" || msgs[1] != "<13>second" || msgs[2] != "<13>th\nird" {
+		t.Errorf("invalid messages: %q", msgs)
+	}
+}
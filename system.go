@@ -0,0 +1,188 @@
+package main
+
+import (
+	"github.com/RangelReale/gostatsd/statsd"
+	"strings"
+	"sync"
+	"time"
+)
+
+// interval to send internal counters to the database
+const systemFlushInterval = 10 * time.Second
+
+// maximum distinct buckets kept on the totals since start, new buckets over it are
+// still sent to the database but not kept
+const systemMaxTotals = 1000
+
+// appstatsd self metrics
+const (
+	systemListenerPackets = "_appstatsd.listener#%s.packets"
+	systemParseErrors     = "_appstatsd.parse#%s.errors"
+	systemDBInvalid       = "_appstatsd.database.invalid"
+	systemDBErrors        = "_appstatsd.database.errors"
+	systemDBQueue         = "_appstatsd.database.queue"
+	systemDBUpsert        = "_appstatsd.database.upsert"
+	systemGraphiteErrors  = "_appstatsd.graphite.errors"
+	systemGraphiteDropped = "_appstatsd.graphite.dropped"
+)
+
+// aggregated timings
+type systemTiming struct {
+	Count int64   `json:"count"`
+	Total float64 `json:"total"` // milliseconds
+}
+
+var (
+	// guards all internal metrics
+	systemCountersMu sync.Mutex
+
+	// values since the last flush
+	systemCounters = make(map[string]float64)
+	systemTimings  = make(map[string]*systemTiming)
+
+	// current values, also sent on each flush
+	systemGauges = make(map[string]float64)
+
+	// totals since start, for /debug/metrics, limited to systemMaxTotals buckets
+	systemCounterTotals = make(map[string]float64)
+	systemTimingTotals  = make(map[string]*systemTiming)
+
+	systemParamReplacer = strings.NewReplacer(".", "_", "#", "_")
+)
+
+// Counts an internal event. The bucket app must start with underline, like
+// _system.throttle#app1.metrics. Counters are aggregated in memory, and sent
+// to the database periodically.
+func SystemCount(bucket string, value float64) {
+	systemCountersMu.Lock()
+	systemCounters[bucket] += value
+	if _, ok := systemCounterTotals[bucket]; ok || len(systemCounterTotals) < systemMaxTotals {
+		systemCounterTotals[bucket] += value
+	}
+	systemCountersMu.Unlock()
+}
+
+// Sets the current value of an internal gauge
+func SystemGauge(bucket string, value float64) {
+	systemCountersMu.Lock()
+	systemGauges[bucket] = value
+	systemCountersMu.Unlock()
+}
+
+// Records the duration of an internal operation, saved as a timer in milliseconds
+func SystemTiming(bucket string, d time.Duration) {
+	ms := float64(d) / float64(time.Millisecond)
+
+	systemCountersMu.Lock()
+	systemTimingAdd(systemTimings, bucket, ms)
+	if _, ok := systemTimingTotals[bucket]; ok || len(systemTimingTotals) < systemMaxTotals {
+		systemTimingAdd(systemTimingTotals, bucket, ms)
+	}
+	systemCountersMu.Unlock()
+}
+
+func systemTimingAdd(timings map[string]*systemTiming, bucket string, ms float64) {
+	t, ok := timings[bucket]
+	if !ok {
+		t = &systemTiming{}
+		timings[bucket] = t
+	}
+	t.Count++
+	t.Total += ms
+}
+
+// Internal metrics since start
+type SystemMetrics struct {
+	Counters map[string]float64       `json:"counters"`
+	Gauges   map[string]float64       `json:"gauges"`
+	Timings  map[string]*systemTiming `json:"timings"`
+}
+
+// Returns a copy of the internal metrics since start
+func SystemSnapshot() *SystemMetrics {
+	systemCountersMu.Lock()
+	defer systemCountersMu.Unlock()
+
+	m := &SystemMetrics{
+		Counters: make(map[string]float64, len(systemCounterTotals)),
+		Gauges:   make(map[string]float64, len(systemGauges)),
+		Timings:  make(map[string]*systemTiming, len(systemTimingTotals)),
+	}
+	for b, v := range systemCounterTotals {
+		m.Counters[b] = v
+	}
+	for b, v := range systemGauges {
+		m.Gauges[b] = v
+	}
+	for b, t := range systemTimingTotals {
+		tc := *t
+		m.Timings[b] = &tc
+	}
+	return m
+}
+
+// Sanitizes a value to be used as a bucket parameter
+func SystemParam(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return systemParamReplacer.Replace(value)
+}
+
+// closed when the periodic flush stops on shutdown
+var systemStopped = make(chan struct{})
+
+// Send aggregated internal counters to the database, until shutdown
+func ServerSystem() {
+	defer close(systemStopped)
+
+	ticker := time.NewTicker(systemFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			systemFlush()
+		case <-shutdownChan:
+			return
+		}
+	}
+}
+
+func systemFlush() {
+	SystemGauge(systemDBQueue, float64(len(DatabaseChan)))
+
+	systemCountersMu.Lock()
+	counters := systemCounters
+	systemCounters = make(map[string]float64)
+	timings := systemTimings
+	systemTimings = make(map[string]*systemTiming)
+	gauges := make(map[string]float64, len(systemGauges))
+	for bucket, value := range systemGauges {
+		gauges[bucket] = value
+	}
+	systemCountersMu.Unlock()
+
+	now := time.Now()
+	for bucket, value := range counters {
+		DatabaseChan <- DBMessage{metrics: &statsd.Metric{
+			Type:   statsd.COUNTER,
+			Bucket: bucket,
+			Value:  value,
+		}, date: now, system: true}
+	}
+	for bucket, value := range gauges {
+		DatabaseChan <- DBMessage{metrics: &statsd.Metric{
+			Type:   statsd.GAUGE,
+			Bucket: bucket,
+			Value:  value,
+		}, date: now, system: true}
+	}
+	for bucket, t := range timings {
+		DatabaseChan <- DBMessage{metrics: &statsd.Metric{
+			Type:   statsd.TIMER,
+			Bucket: bucket,
+			Value:  t.Total,
+		}, date: now, system: true, samples: t.Count}
+	}
+}
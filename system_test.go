@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSystemSnapshot(t *testing.T) {
+	SystemCount("_test.snapshot.ct", 1)
+	SystemCount("_test.snapshot.ct", 2)
+	SystemGauge("_test.snapshot.gg", 5)
+	SystemTiming("_test.snapshot.tm", 10*time.Millisecond)
+	SystemTiming("_test.snapshot.tm", 30*time.Millisecond)
+
+	m := SystemSnapshot()
+	if v := m.Counters["_test.snapshot.ct"]; v != 3 {
+		t.Errorf("counter: expected 3, got %f", v)
+	}
+	if v := m.Gauges["_test.snapshot.gg"]; v != 5 {
+		t.Errorf("gauge: expected 5, got %f", v)
+	}
+	tm := m.Timings["_test.snapshot.tm"]
+	if tm == nil || tm.Count != 2 || tm.Total != 40 {
+		t.Errorf("timing: expected 2 samples totaling 40, got %+v", tm)
+	}
+
+	// the snapshot is a copy
+	SystemCount("_test.snapshot.ct", 1)
+	if v := m.Counters["_test.snapshot.ct"]; v != 3 {
+		t.Errorf("snapshot changed: expected 3, got %f", v)
+	}
+}
+
+func TestSystemTotalsLimit(t *testing.T) {
+	for i := 0; i < systemMaxTotals+10; i++ {
+		SystemCount(fmt.Sprintf("_test.limit#p%d.ct", i), 1)
+	}
+
+	systemCountersMu.Lock()
+	totals := len(systemCounterTotals)
+	_, flushed := systemCounters[fmt.Sprintf("_test.limit#p%d.ct", systemMaxTotals+5)]
+	systemCountersMu.Unlock()
+
+	if totals > systemMaxTotals {
+		t.Errorf("totals should be limited to %d buckets, got %d", systemMaxTotals, totals)
+	}
+	if !flushed {
+		t.Error("buckets over the totals limit should still be sent to the database")
+	}
+}
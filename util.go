@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// latest accepted timestamp, 9999-12-31T23:59:59Z, as dates are saved with 4-digit years
+const maxUnixTimestamp = 253402300799
+
+// Converts unix seconds with optional fraction to time
+func unixSecondsToTime(ts float64) time.Time {
+	sec := int64(ts)
+	return time.Unix(sec, int64((ts-float64(sec))*1e9))
+}
+
+// Parses unix seconds with optional fraction
+func parseUnixTimestamp(ts string) (time.Time, error) {
+	tsfloat, err := strconv.ParseFloat(ts, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %s", ts)
+	}
+	return checkedUnixSecondsToTime(tsfloat)
+}
+
+// Converts unix seconds with optional fraction to time, if between the epoch and maxUnixTimestamp
+func checkedUnixSecondsToTime(ts float64) (time.Time, error) {
+	if math.IsNaN(ts) || ts < 0 || ts > maxUnixTimestamp {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %v", ts)
+	}
+	return unixSecondsToTime(ts), nil
+}
+
+// Checks if a client-supplied timestamp is inside the allowed skew from the current time
+func validateTimestamp(tm time.Time) error {
+	configMu.RLock()
+	maxskew := Configuration.MaxTimestampSkew
+	configMu.RUnlock()
+
+	if maxskew <= 0 {
+		return nil
+	}
+
+	skew := time.Since(tm)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(maxskew)*time.Second {
+		return fmt.Errorf("timestamp %s outside of allowed skew of %d seconds", tm.Format(time.RFC3339), maxskew)
+	}
+	return nil
+}